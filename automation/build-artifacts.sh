@@ -24,11 +24,14 @@ make build
 # Save the images to tar files:
 make save
 
-# Move the generated artifacts and log files to the artifacts directory:
+# Move the generated artifacts, their metadata and checksums, and the log
+# files to the artifacts directory:
 mv \
     tools/bin/ovc \
     *.log \
     *.tar.gz \
+    *.metadata.json \
+    SHA256SUMS \
     exported-artifacts
 
 # Pushing the images to the registry is currently disabled because
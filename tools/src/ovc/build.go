@@ -16,23 +16,116 @@ limitations under the License.
 
 package main
 
-// This tool builds all the images.
+// This tool builds the images. The images to build can be given in the
+// command line, otherwise all the images are built. Images that don't
+// depend on each other are built concurrently, and images whose
+// contents haven't changed since the last build are skipped.
 
 import (
 	"fmt"
+	"runtime"
 
 	"ovc/build"
 	"ovc/log"
 )
 
-func buildTool(project *build.Project) error {
+// Command line options of the tool.
+//
+var (
+	buildSelection   imageSelection
+	buildJobs        int
+	buildForce       bool
+	buildNoAncestors bool
+)
+
+func init() {
+	tool := registerTool(
+		"build",
+		"[IMAGE...]",
+		"Builds the images, or only the given images and their missing ancestors",
+		buildTool,
+	)
+	buildSelection.addFlags(tool.Flags)
+	tool.Flags.IntVar(
+		&buildJobs,
+		"jobs",
+		runtime.NumCPU(),
+		"maximum `number` of images to build concurrently",
+	)
+	tool.Flags.BoolVar(
+		&buildForce,
+		"force",
+		false,
+		"build the selected images even if they are up to date",
+	)
+	tool.Flags.BoolVar(
+		&buildNoAncestors,
+		"no-ancestors",
+		false,
+		"don't build the missing ancestors of the selected images",
+	)
+}
+
+func buildTool(project *build.Project, args []string) error {
+	// Select the images given in the command line:
+	selected, err := buildSelection.images(project, args)
+	if err != nil {
+		return err
+	}
+	included := make(map[*build.Image]bool)
+	for _, image := range selected {
+		included[image] = true
+	}
+
+	// Add the ancestors of the selected images that aren't available
+	// in the local image storage, as otherwise the selected images
+	// can't be built:
+	if !buildNoAncestors {
+		checked := make(map[*build.Image]bool)
+		for _, image := range selected {
+			for _, ancestor := range image.Ancestors() {
+				if included[ancestor] || checked[ancestor] {
+					continue
+				}
+				checked[ancestor] = true
+				current, err := ancestor.UpToDate()
+				if err != nil {
+					return err
+				}
+				if !current {
+					log.Info("Adding missing ancestor '%s' of image '%s'", ancestor, image)
+					included[ancestor] = true
+				}
+			}
+		}
+	}
+	images := []*build.Image{}
 	for _, image := range project.Images().List() {
-		log.Info("Building image '%s'", image)
-		err := image.Build()
-		if err != nil {
-			return fmt.Errorf("Failed to build image '%s'", image)
+		if included[image] {
+			images = append(images, image)
 		}
 	}
 
-	return nil
+	// Build the images, making sure that each image is built only
+	// after its dependencies. The force option only applies to the images
+	// selected explicitly, not to the missing ancestors.
+	forced := make(map[*build.Image]bool)
+	if buildForce {
+		for _, image := range selected {
+			forced[image] = true
+		}
+	}
+	log.Info("Building images with up to %d concurrent jobs", buildJobs)
+	return build.RunParallel(
+		images,
+		buildJobs,
+		func(image *build.Image) error {
+			log.Info("Building image '%s'", image)
+			err := image.Build(forced[image])
+			if err != nil {
+				return fmt.Errorf("Failed to build image '%s'", image)
+			}
+			return nil
+		},
+	)
 }
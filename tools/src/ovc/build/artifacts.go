@@ -0,0 +1,444 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+// This file contains the functions that write the integrity information
+// of the saved artifacts, the metadata files that describe each saved
+// image and the 'SHA256SUMS' file, and the functions that check them.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChecksumsFile is the name of the file that contains the checksums of
+// the artifacts of a directory, in the format used by the 'sha256sum'
+// command, so that it can also be checked with 'sha256sum --check'.
+//
+const ChecksumsFile = "SHA256SUMS"
+
+// The suffix that is added to the name of a saved image to get the name
+// of its metadata file.
+//
+const metadataSuffix = ".metadata.json"
+
+// ArtifactMetadata describes an image saved to a file or directory, or
+// a bundle that contains multiple images.
+//
+type ArtifactMetadata struct {
+	// The name of the image, for example 'engine'. Empty for
+	// bundles.
+	Name string `json:"name,omitempty"`
+
+	// The primary tag of the image. Empty for bundles.
+	Tag string `json:"tag,omitempty"`
+
+	// All the tags of the image. Empty for bundles.
+	Tags []string `json:"tags,omitempty"`
+
+	// The identifier of the image in the local image storage. Empty
+	// for bundles.
+	ID string `json:"id,omitempty"`
+
+	// The time when the image was created, or when the bundle was
+	// written.
+	Created time.Time `json:"created"`
+
+	// The format and compression of the artifact.
+	Format      string `json:"format"`
+	Compression string `json:"compression"`
+
+	// The name of the artifact, relative to the directory that
+	// contains the metadata file.
+	File string `json:"file"`
+
+	// The size of the artifact in bytes. For directories it is the
+	// sum of the sizes of the files that they contain.
+	Size int64 `json:"size"`
+
+	// The SHA-256 checksum of the artifact, empty for directories.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// For bundles, the images that they contain, as described by
+	// the index of the bundle.
+	Images []*BundleImage `json:"images,omitempty"`
+}
+
+// MetadataPath returns the path of the metadata file of the image saved
+// to the given path.
+//
+func MetadataPath(path string) string {
+	return path + metadataSuffix
+}
+
+// writeMetadata writes the metadata file of the image saved to the
+// given path.
+//
+func (i *Image) writeMetadata(path, format, compression string) error {
+	engine := i.project.Images().Engine()
+	id, err := engine.ID(i.tag)
+	if err != nil {
+		return err
+	}
+	created, err := engine.Created(i.tag)
+	if err != nil {
+		return err
+	}
+	metadata := &ArtifactMetadata{
+		Name:        i.name,
+		Tag:         i.tag,
+		Tags:        i.tags,
+		ID:          id,
+		Created:     created.UTC(),
+		Format:      format,
+		Compression: compression,
+		File:        filepath.Base(path),
+	}
+	if format == FormatOCIDir {
+		metadata.Compression = CompressionNone
+	}
+	return writeMetadata(path, metadata)
+}
+
+// writeBundleMetadata writes the metadata file of the bundle saved to
+// the given path, including the description of the images that it
+// contains.
+//
+func writeBundleMetadata(path string, index *BundleIndex, compression string) error {
+	metadata := &ArtifactMetadata{
+		Created:     time.Now().UTC(),
+		Format:      index.Format,
+		Compression: compression,
+		File:        filepath.Base(path),
+		Images:      index.Images,
+	}
+	return writeMetadata(path, metadata)
+}
+
+// writeMetadata calculates the size and checksum of the artifact saved
+// to the given path, and writes its metadata file.
+//
+func writeMetadata(path string, metadata *ArtifactMetadata) (err error) {
+	metadata.Size, metadata.SHA256, err = artifactChecksum(path)
+	if err != nil {
+		return
+	}
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(MetadataPath(path), data, 0644)
+}
+
+// artifactChecksum calculates the size and the SHA-256 checksum of the
+// given file. For directories it calculates the sum of the sizes of the
+// files that they contain, and returns an empty checksum.
+//
+func artifactChecksum(path string) (size int64, sum string, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		return fileChecksum(path)
+	}
+	err = filepath.Walk(path, func(current string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// fileChecksum calculates the size and the SHA-256 checksum of the given
+// file.
+//
+func fileChecksum(path string) (size int64, sum string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err = io.Copy(hash, file)
+	if err != nil {
+		return
+	}
+	sum = hex.EncodeToString(hash.Sum(nil))
+	return
+}
+
+// WriteChecksums adds to the checksums file of the given directory the
+// checksums of the given files, which should be inside that directory.
+// For directories the checksums of all the files that they contain are
+// added. Entries already present in the file for other artifacts are
+// preserved, so that saving images in multiple steps to the same
+// directory results in a complete checksums file.
+//
+func WriteChecksums(dir string, paths []string) error {
+	sums, err := readChecksums(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if sums == nil {
+		sums = make(map[string]string)
+	}
+	for _, path := range paths {
+		err = filepath.Walk(path, func(current string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			name, err := filepath.Rel(dir, current)
+			if err != nil {
+				return err
+			}
+			name = filepath.ToSlash(name)
+
+			// Forget the previous contents of directories, as
+			// they have been replaced:
+			if info.IsDir() {
+				for old := range sums {
+					if strings.HasPrefix(old, name+"/") {
+						delete(sums, old)
+					}
+				}
+				return nil
+			}
+			_, sum, err := fileChecksum(current)
+			if err != nil {
+				return err
+			}
+			sums[name] = sum
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write the file, sorted by name so that it is stable:
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buffer := new(strings.Builder)
+	for _, name := range names {
+		fmt.Fprintf(buffer, "%s  %s\n", sums[name], name)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ChecksumsFile), []byte(buffer.String()), 0644)
+}
+
+// HasChecksum checks if the checksums file of the given directory exists
+// and contains the checksum of the file with the given name.
+//
+func HasChecksum(dir, name string) (bool, error) {
+	sums, err := readChecksums(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, present := sums[name]
+	return present, nil
+}
+
+// readChecksums reads the checksums file of the given directory, and
+// returns a map from the names of the files to their checksums.
+//
+func readChecksums(dir string) (sums map[string]string, err error) {
+	path := filepath.Join(dir, ChecksumsFile)
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	sums = make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			err = fmt.Errorf("Line %d of checksums file '%s' isn't valid", number, path)
+			return
+		}
+
+		// The 'sha256sum' command separates the checksum and the
+		// name with a space and a second space or an asterisk
+		// that indicates binary mode:
+		name := strings.TrimPrefix(strings.TrimPrefix(fields[1], " "), "*")
+		sums[name] = strings.ToLower(fields[0])
+	}
+	err = scanner.Err()
+	return
+}
+
+// VerifyArtifacts checks the artifacts of the given directory against
+// the checksums file and the metadata files. If names are given only
+// those artifacts, and the files inside them if they are directories,
+// are checked, otherwise all the artifacts listed in the checksums file
+// are checked. Returns the descriptions of the problems found. The
+// error is reserved to problems that prevent the verification, like a
+// missing checksums file.
+//
+func VerifyArtifacts(dir string, names ...string) (problems []string, err error) {
+	sums, err := readChecksums(dir)
+	if err != nil {
+		err = fmt.Errorf("Can't read checksums of directory '%s': %s", dir, err)
+		return
+	}
+
+	// Select the entries to check:
+	selected := []string{}
+	for name := range sums {
+		if len(names) == 0 {
+			selected = append(selected, name)
+			continue
+		}
+		for _, wanted := range names {
+			if name == wanted || strings.HasPrefix(name, wanted+"/") {
+				selected = append(selected, name)
+				break
+			}
+		}
+	}
+	for _, wanted := range names {
+		found := false
+		for _, name := range selected {
+			if name == wanted || strings.HasPrefix(name, wanted+"/") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: isn't listed in '%s'", wanted, ChecksumsFile))
+		}
+	}
+	sort.Strings(selected)
+
+	// Check the checksums:
+	for _, name := range selected {
+		_, sum, err := fileChecksum(filepath.Join(dir, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			problems = append(problems, fmt.Sprintf("%s: is missing", name))
+			continue
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: can't be read: %s", name, err))
+			continue
+		}
+		if sum != sums[name] {
+			problems = append(problems, fmt.Sprintf("%s: checksum doesn't match", name))
+		}
+	}
+
+	// Check that the metadata files are consistent with the artifacts
+	// that they describe:
+	for _, name := range selected {
+		if !strings.HasSuffix(name, metadataSuffix) {
+			continue
+		}
+		problem := checkMetadata(dir, name, sums)
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, problem))
+		}
+	}
+	return
+}
+
+// checkMetadata checks that the size and checksum of the artifact
+// described by the given metadata file match the metadata. Returns a
+// description of the problem, or an empty string if there is no
+// problem.
+//
+func checkMetadata(dir, name string, sums map[string]string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return fmt.Sprintf("can't be read: %s", err)
+	}
+	metadata := new(ArtifactMetadata)
+	err = json.Unmarshal(data, metadata)
+	if err != nil {
+		return fmt.Sprintf("can't be parsed: %s", err)
+	}
+	file := filepath.ToSlash(filepath.Join(filepath.Dir(filepath.FromSlash(name)), metadata.File))
+	size, _, err := artifactChecksum(filepath.Join(dir, filepath.FromSlash(file)))
+	if err != nil {
+		return fmt.Sprintf("artifact '%s' can't be read: %s", file, err)
+	}
+	if size != metadata.Size {
+		return fmt.Sprintf("size of artifact '%s' is %d, but it should be %d", file, size, metadata.Size)
+	}
+	if metadata.SHA256 != "" && metadata.SHA256 != sums[file] {
+		return fmt.Sprintf("checksum of artifact '%s' doesn't match '%s'", file, ChecksumsFile)
+	}
+	if len(metadata.Images) > 0 {
+		return checkBundleMetadata(filepath.Join(dir, filepath.FromSlash(file)), metadata)
+	}
+	return ""
+}
+
+// checkBundleMetadata checks that the images described by the metadata
+// of a bundle are the ones described by the index of the bundle.
+// Returns a description of the problem, or an empty string if there is
+// no problem.
+//
+func checkBundleMetadata(bundle string, metadata *ArtifactMetadata) string {
+	index, err := ReadBundleIndex(bundle)
+	if err != nil {
+		return err.Error()
+	}
+	if len(index.Images) != len(metadata.Images) {
+		return fmt.Sprintf(
+			"bundle contains %d images, but it should contain %d",
+			len(index.Images),
+			len(metadata.Images),
+		)
+	}
+	for i, expected := range metadata.Images {
+		actual := index.Images[i]
+		same := actual.Name == expected.Name &&
+			actual.ID == expected.ID &&
+			reflect.DeepEqual(actual.Tags, expected.Tags) &&
+			actual.Created.Equal(expected.Created) &&
+			actual.Size == expected.Size &&
+			actual.File == expected.File
+		if !same {
+			return fmt.Sprintf("image '%s' of the bundle doesn't match the metadata", expected.Name)
+		}
+	}
+	return ""
+}
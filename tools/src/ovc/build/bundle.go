@@ -0,0 +1,836 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+// This file contains the functions used to write the images, the
+// rendered manifests and the effective configuration of the project to
+// a single bundle file, and to load the images from that file into the
+// local image storage, extracting the manifests and the configuration,
+// without the need of the project.
+//
+// A bundle is a tar file, optionally compressed, that contains the
+// following entries, in this order:
+//
+//	index.json    - The description of the content of the bundle.
+//	project.conf  - The effective configuration of the project.
+//	images/*.tar  - One docker-archive for each image, or...
+//	oci/          - ...a single OCI image layout with all the images.
+//	os-manifests/ - The rendered manifests.
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"ovc/log"
+)
+
+// Names of the entries of the bundle.
+//
+const (
+	bundleIndexEntry  = "index.json"
+	bundleConfigEntry = "project.conf"
+	bundleImagesDir   = "images"
+	bundleLayoutDir   = "oci"
+)
+
+// BundleIndex describes the content of a bundle.
+//
+type BundleIndex struct {
+	// The version of the project.
+	Version string `json:"version"`
+
+	// The format of the files that contain the images, either
+	// 'docker-archive' or 'oci'.
+	Format string `json:"format"`
+
+	// The images contained in the bundle.
+	Images []*BundleImage `json:"images"`
+
+	// The name of the directory of the bundle that contains the
+	// rendered manifests.
+	Manifests string `json:"manifests"`
+}
+
+// BundleImage describes one of the images contained in a bundle.
+//
+type BundleImage struct {
+	// The name of the image, for example 'engine'.
+	Name string `json:"name"`
+
+	// The identifier of the image in the image storage where the
+	// bundle was created.
+	ID string `json:"id"`
+
+	// The tags of the image. The first one is the primary tag, the
+	// one that is stored inside the archive file.
+	Tags []string `json:"tags"`
+
+	// The time when the image was created.
+	Created time.Time `json:"created"`
+
+	// The size in bytes of the image in docker-archive format,
+	// without compression.
+	Size int64 `json:"size"`
+
+	// The name of the entry of the bundle that contains the image,
+	// in the format indicated by the index. For the 'oci' format
+	// it is the directory that contains the OCI image layout shared
+	// by all the images.
+	File string `json:"file"`
+}
+
+// BundleOptions contains the parameters used to save bundles.
+//
+type BundleOptions struct {
+	// The compression algorithm of the bundle, one of 'gzip',
+	// 'pgzip', 'zstd' or 'none'. If empty 'gzip' will be used.
+	Compression string
+
+	// The format of the images inside the bundle, either
+	// 'docker-archive' or 'oci'. If empty 'docker-archive' will be
+	// used.
+	Format string
+
+	// The maximum number of images to extract from the container
+	// engine concurrently.
+	Jobs int
+}
+
+// LoadOptions contains the parameters used to load bundles.
+//
+type LoadOptions struct {
+	// The container engine where the images will be loaded.
+	Engine ContainerEngine
+
+	// The registry that will be added to the tags of the loaded
+	// images, replacing the registry that they had when the bundle
+	// was created. If empty the images will keep the original tags.
+	Registry string
+
+	// Push the loaded images to the registry after loading them.
+	Push bool
+
+	// The directory where the configuration and the rendered
+	// manifests contained in the bundle will be extracted. When a
+	// registry is given the references to the images inside the
+	// manifests are changed to use it. If empty nothing is
+	// extracted.
+	Directory string
+}
+
+// SaveBundle writes the given images, the rendered manifests and the
+// effective configuration of the project to the bundle file with the
+// given path, and writes the metadata file of the bundle next to it.
+// The entries of a tar file need to know their sizes in advance, so the
+// images are first extracted from the container engine to a temporary
+// directory, next to the bundle, and then copied to the bundle. In the
+// 'oci' format all the images are added to the same OCI
+// image layout, so that the layers that they share are stored once.
+//
+func (p *Project) SaveBundle(bundle string, images []*Image, options *BundleOptions) (err error) {
+	compression := options.Compression
+	if compression == "" {
+		compression = CompressionGzip
+	}
+	format := options.Format
+	if format == "" {
+		format = FormatDockerArchive
+	}
+	if format == FormatOCIDir {
+		return fmt.Errorf("Format '%s' can't be used in bundles, use '%s' instead", format, FormatOCI)
+	}
+
+	// Prepare the index, which also checks that all the images are
+	// available in the local image storage:
+	manifests, err := filepath.Rel(p.WorkingDirectory(), p.Manifests().WorkingDirectory())
+	if err != nil {
+		return
+	}
+	index := &BundleIndex{
+		Version:   p.Version(),
+		Format:    format,
+		Images:    make([]*BundleImage, len(images)),
+		Manifests: filepath.ToSlash(manifests),
+	}
+	for i, image := range images {
+		id, err := image.ID()
+		if err != nil {
+			return fmt.Errorf("Can't find image '%s', it may need to be built: %s", image, err)
+		}
+		created, err := p.Images().Engine().Created(image.Tag())
+		if err != nil {
+			return err
+		}
+		index.Images[i] = &BundleImage{
+			Name:    image.Name(),
+			ID:      id,
+			Tags:    image.Tags(),
+			Created: created.UTC(),
+			File:    path.Join(bundleImagesDir, fileNameTag(image.Tag())+FormatExtension(format, CompressionNone)),
+		}
+		if format == FormatOCI {
+			index.Images[i].File = bundleLayoutDir
+		}
+	}
+
+	// Extract the images to the temporary directory:
+	tmpDir, err := ioutil.TempDir(filepath.Dir(bundle), ".bundle")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	files := make(map[string]string)
+	for _, image := range images {
+		files[image.Name()] = filepath.Join(tmpDir, fileNameTag(image.Tag())+".tar")
+	}
+	err = RunConcurrently(images, options.Jobs, func(image *Image) error {
+		log.Info("Extracting image '%s'", image)
+		return image.writeArchive(files[image.Name()], CompressionNone)
+	})
+	if err != nil {
+		return
+	}
+	for _, image := range index.Images {
+		var info os.FileInfo
+		info, err = os.Stat(files[image.Name])
+		if err != nil {
+			return
+		}
+		image.Size = info.Size()
+	}
+
+	// Convert the images to a single OCI layout, if needed:
+	layout := ""
+	if format == FormatOCI {
+		layout = filepath.Join(tmpDir, bundleLayoutDir)
+		err = writeBundleLayout(layout, index, files)
+		if err != nil {
+			return
+		}
+	}
+
+	// Write the bundle:
+	err = writeCompressedFile(bundle, compression, func(out io.Writer) error {
+		return p.writeBundle(tar.NewWriter(out), index, files, layout)
+	})
+	if err != nil {
+		return
+	}
+
+	// Write the metadata file next to the bundle:
+	err = writeBundleMetadata(bundle, index, compression)
+	return
+}
+
+// writeBundleLayout creates in the given directory an OCI image layout
+// that contains all the images of the index, converted from the given
+// docker-archive files, which are removed as soon as they are added.
+//
+func writeBundleLayout(dir string, index *BundleIndex, files map[string]string) error {
+	layout, err := newOCILayout(dir, index.Version)
+	if err != nil {
+		return err
+	}
+	for _, image := range index.Images {
+		log.Info("Adding image '%s' to OCI layout", image.Name)
+		err = layout.addArchive(files[image.Name], image.Tags)
+		if err != nil {
+			return err
+		}
+		os.Remove(files[image.Name])
+	}
+	return layout.close()
+}
+
+// writeBundle writes to the given tar file the index, the configuration,
+// the images and the manifests. The images are taken from the given
+// OCI layout directory, if it isn't empty, or else from the given
+// docker-archive files.
+//
+func (p *Project) writeBundle(writer *tar.Writer, index *BundleIndex, files map[string]string, layout string) error {
+	// Write the index and the configuration:
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = addTarData(writer, bundleIndexEntry, data)
+	if err != nil {
+		return err
+	}
+	config := new(strings.Builder)
+	err = p.WriteConfig(config)
+	if err != nil {
+		return err
+	}
+	err = addTarData(writer, bundleConfigEntry, []byte(config.String()))
+	if err != nil {
+		return err
+	}
+
+	// Write the images, either the OCI layout or the docker-archive
+	// files, removing the temporary files as soon as they are
+	// copied:
+	if layout != "" {
+		log.Info("Adding OCI layout to bundle")
+		err = addTarDirectory(writer, bundleLayoutDir, layout)
+		if err != nil {
+			return err
+		}
+		os.RemoveAll(layout)
+	} else {
+		for _, image := range index.Images {
+			log.Info("Adding image '%s' to bundle", image.Name)
+			err = addTarFile(writer, image.File, files[image.Name])
+			if err != nil {
+				return err
+			}
+			os.Remove(files[image.Name])
+		}
+	}
+
+	// Write the manifests:
+	log.Info("Adding manifests to bundle")
+	err = addTarDirectory(writer, index.Manifests, p.Manifests().WorkingDirectory())
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// addTarData adds to the tar file an entry with the given name that
+// contains the given data.
+//
+func addTarData(writer *tar.Writer, name string, data []byte) error {
+	err := writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+// addTarFile adds to the tar file an entry with the given name that
+// contains a copy of the given file.
+//
+func addTarFile(writer *tar.Writer, name, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	err = writer.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+// addTarDirectory adds to the tar file the given directory and all its
+// contents, with the given name. If the name is empty the contents are
+// added to the root of the tar file.
+//
+func addTarDirectory(writer *tar.Writer, name, dir string) error {
+	return filepath.Walk(dir, func(current string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(dir, current)
+		if err != nil {
+			return err
+		}
+		entry := path.Join(name, filepath.ToSlash(relative))
+		if entry == "." {
+			return nil
+		}
+		if info.IsDir() {
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = entry + "/"
+			return writer.WriteHeader(header)
+		}
+		return addTarFile(writer, entry, current)
+	})
+}
+
+// LoadBundle loads the images contained in the given bundle file into
+// the local image storage, and adds to them all the tags that they had
+// when the bundle was created. If a registry is given in the options
+// the images are also tagged for that registry, and if requested they
+// are pushed. If a directory is given in the options the configuration
+// and the manifests are extracted to it. Returns the index of the
+// bundle.
+//
+func LoadBundle(bundle string, options *LoadOptions) (index *BundleIndex, err error) {
+	file, err := os.Open(bundle)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	decompressor, err := NewDecompressor(file)
+	if err != nil {
+		err = fmt.Errorf("Can't read bundle '%s': %s", bundle, err)
+		return
+	}
+	defer decompressor.Close()
+	reader := tar.NewReader(decompressor)
+	index, err = readBundleIndex(bundle, reader)
+	if err != nil {
+		return
+	}
+	log.Info("Bundle '%s' contains version '%s' of the project", bundle, index.Version)
+
+	// Prepare the directory where the configuration and the manifests
+	// will be extracted, removing the manifests extracted from other
+	// bundles:
+	if options.Directory != "" {
+		manifests := path.Clean(index.Manifests)
+		if index.Manifests == "" || manifests == "." || path.IsAbs(manifests) || strings.HasPrefix(manifests, "..") {
+			err = fmt.Errorf("Manifests directory '%s' of bundle '%s' isn't valid", index.Manifests, bundle)
+			return
+		}
+		err = os.RemoveAll(filepath.Join(options.Directory, filepath.FromSlash(manifests)))
+		if err != nil {
+			return
+		}
+		err = os.MkdirAll(options.Directory, 0755)
+		if err != nil {
+			err = fmt.Errorf("Can't create directory '%s': %s", options.Directory, err)
+			return
+		}
+	}
+	images := make(map[string]*BundleImage)
+	for _, image := range index.Images {
+		if len(image.Tags) == 0 {
+			err = fmt.Errorf("Image '%s' of bundle '%s' doesn't have tags", image.Name, bundle)
+			return
+		}
+		images[image.File] = image
+	}
+	layout := index.Format == FormatOCI
+
+	// Load the images, one at a time, as they appear in the bundle.
+	// Each image is first extracted to a temporary file, because
+	// not all the container engines can read it from a pipe. In
+	// the 'oci' format the layout is extracted to a temporary
+	// directory, and all the images are loaded from it at the end:
+	tmpDir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	loaded := make(map[*BundleImage]bool)
+	for {
+		var header *tar.Header
+		header, err = reader.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			err = fmt.Errorf("Can't read bundle '%s': %s", bundle, err)
+			return
+		}
+		if options.Directory != "" && isBundleFileEntry(index, header.Name) {
+			err = extractBundleEntry(reader, header, options.Directory)
+			if err != nil {
+				err = fmt.Errorf("Can't extract entry '%s' of bundle '%s': %s", header.Name, bundle, err)
+				return
+			}
+			continue
+		}
+		if layout {
+			if header.Name == bundleLayoutDir+"/" || strings.HasPrefix(header.Name, bundleLayoutDir+"/") {
+				err = extractBundleEntry(reader, header, tmpDir)
+				if err != nil {
+					err = fmt.Errorf("Can't extract entry '%s' of bundle '%s': %s", header.Name, bundle, err)
+					return
+				}
+			}
+			continue
+		}
+		image := images[header.Name]
+		if image == nil {
+			continue
+		}
+		tmp := filepath.Join(tmpDir, path.Base(header.Name))
+		err = writeFile(tmp, reader)
+		if err != nil {
+			return
+		}
+		err = loadBundleImage(image, tmp, options)
+		os.Remove(tmp)
+		if err != nil {
+			err = fmt.Errorf("Failed to load image '%s': %s", image.Name, err)
+			return
+		}
+		loaded[image] = true
+	}
+	if layout {
+		err = loadBundleLayout(index, filepath.Join(tmpDir, bundleLayoutDir), options)
+		if err != nil {
+			return
+		}
+		for _, image := range index.Images {
+			loaded[image] = true
+		}
+	}
+
+	// Check that all the images in the index were present:
+	for _, image := range index.Images {
+		if !loaded[image] {
+			err = fmt.Errorf("Bundle '%s' doesn't contain image '%s'", bundle, image.Name)
+			return
+		}
+	}
+
+	// Change the references to the images inside the extracted
+	// manifests, so that they use the new registry:
+	if options.Directory != "" && options.Registry != "" {
+		dir := filepath.Join(options.Directory, filepath.FromSlash(index.Manifests))
+		log.Info("Changing registry of images in manifests to '%s'", options.Registry)
+		err = replaceImageReferences(dir, index, options.Registry)
+	}
+	return
+}
+
+// ReadBundleIndex reads the index of the given bundle file, without
+// reading the rest of the bundle.
+//
+func ReadBundleIndex(bundle string) (index *BundleIndex, err error) {
+	file, err := os.Open(bundle)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	decompressor, err := NewDecompressor(file)
+	if err != nil {
+		err = fmt.Errorf("Can't read bundle '%s': %s", bundle, err)
+		return
+	}
+	defer decompressor.Close()
+	return readBundleIndex(bundle, tar.NewReader(decompressor))
+}
+
+// readBundleIndex reads the index of a bundle from the given reader,
+// which should be positioned at the beginning of the bundle, as the
+// index is always the first entry. The name of the bundle is only used
+// in error messages.
+//
+func readBundleIndex(bundle string, reader *tar.Reader) (index *BundleIndex, err error) {
+	header, err := reader.Next()
+	if err != nil {
+		err = fmt.Errorf("Can't read bundle '%s': %s", bundle, err)
+		return
+	}
+	if header.Name != bundleIndexEntry {
+		err = fmt.Errorf("Bundle '%s' doesn't start with the index", bundle)
+		return
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return
+	}
+	index = new(BundleIndex)
+	err = json.Unmarshal(data, index)
+	if err != nil {
+		err = fmt.Errorf("Can't parse index of bundle '%s': %s", bundle, err)
+		index = nil
+	}
+	return
+}
+
+// isBundleFileEntry checks if the given entry of a bundle is the
+// configuration or one of the rendered manifests.
+//
+func isBundleFileEntry(index *BundleIndex, name string) bool {
+	if name == bundleConfigEntry {
+		return true
+	}
+	return name == index.Manifests || strings.HasPrefix(name, index.Manifests+"/")
+}
+
+// extractBundleEntry extracts the given entry of a bundle to the given
+// directory. Entries whose names would result in files outside of that
+// directory are rejected.
+//
+func extractBundleEntry(reader *tar.Reader, header *tar.Header, dir string) error {
+	name := path.Clean(strings.TrimSuffix(header.Name, "/"))
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("Entry name is outside of the directory")
+	}
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(target, 0755)
+	case tar.TypeReg:
+		err := os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+		err = writeFile(target, reader)
+		if err != nil {
+			return err
+		}
+		return os.Chmod(target, header.FileInfo().Mode().Perm())
+	default:
+		return nil
+	}
+}
+
+// replaceImageReferences replaces, in all the files of the given
+// directory, the tags of the images of the bundle with the same tags
+// for the given registry.
+//
+func replaceImageReferences(dir string, index *BundleIndex, registry string) error {
+	// Sort the tags so that the longest ones are replaced first, as
+	// a tag may be a prefix of another one:
+	tags := []string{}
+	replacements := make(map[string]string)
+	for _, image := range index.Images {
+		for _, tag := range image.Tags {
+			if _, present := replacements[tag]; present {
+				continue
+			}
+			tags = append(tags, tag)
+			replacements[tag] = replaceRegistry(tag, registry)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return len(tags[i]) > len(tags[j])
+	})
+	return filepath.Walk(dir, func(current string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(current)
+		if err != nil {
+			return err
+		}
+		replaced := replaceTags(string(data), tags, replacements)
+		if replaced == string(data) {
+			return nil
+		}
+		log.Debug("Changing registry of images in file '%s'", current)
+		return ioutil.WriteFile(current, []byte(replaced), info.Mode().Perm())
+	})
+}
+
+// replaceTags replaces the given tags inside the given text, but only
+// where they aren't part of a longer reference, like in
+// 'quay.io/ovirt/engine:master' or in 'ovirt/engine:master2'. The tags
+// should be sorted so that the longest ones are checked first.
+//
+func replaceTags(text string, tags []string, replacements map[string]string) string {
+	buffer := new(bytes.Buffer)
+	i := 0
+	for i < len(text) {
+		if i == 0 || !isTagChar(rune(text[i-1])) {
+			tag := matchTag(text[i:], tags)
+			if tag != "" {
+				buffer.WriteString(replacements[tag])
+				i += len(tag)
+				continue
+			}
+		}
+		buffer.WriteByte(text[i])
+		i++
+	}
+	return buffer.String()
+}
+
+// matchTag returns the first of the given tags that the given text
+// starts with, and that isn't followed by a character that can be part
+// of a tag. Returns an empty string if there is no such tag.
+//
+func matchTag(text string, tags []string) string {
+	for _, tag := range tags {
+		if !strings.HasPrefix(text, tag) {
+			continue
+		}
+		if len(text) == len(tag) || !isTagChar(rune(text[len(tag)])) {
+			return tag
+		}
+	}
+	return ""
+}
+
+// loadBundleLayout loads all the images of a bundle from the OCI image
+// layout extracted to the given directory, and adds the tags requested
+// by the options. The layout also contains the manifest used by docker,
+// so it is written to a tar file that all the engines can load.
+//
+func loadBundleLayout(index *BundleIndex, dir string, options *LoadOptions) error {
+	_, err := os.Stat(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return fmt.Errorf("Can't find OCI layout: %s", err)
+	}
+	archive := dir + ".tar"
+	err = writeCompressedFile(archive, CompressionNone, func(out io.Writer) error {
+		writer := tar.NewWriter(out)
+		err := addTarDirectory(writer, "", dir)
+		if err != nil {
+			return err
+		}
+		return writer.Close()
+	})
+	if err != nil {
+		return err
+	}
+	os.RemoveAll(dir)
+	log.Info("Loading %d images from OCI layout", len(index.Images))
+	err = options.Engine.Load(archive)
+	os.Remove(archive)
+	if err != nil {
+		return err
+	}
+	for _, image := range index.Images {
+		err = tagBundleImage(image, options)
+		if err != nil {
+			return fmt.Errorf("Failed to load image '%s': %s", image.Name, err)
+		}
+	}
+	return nil
+}
+
+// loadBundleImage loads one of the images of a bundle from the given
+// archive file, and adds the tags requested by the options.
+//
+func loadBundleImage(image *BundleImage, path string, options *LoadOptions) error {
+	log.Info("Loading image '%s'", image.Tags[0])
+	err := options.Engine.Load(path)
+	if err != nil {
+		return err
+	}
+	return tagBundleImage(image, options)
+}
+
+// tagBundleImage checks that a loaded image of a bundle is the one that
+// was saved, adds the tags requested by the options and pushes it if
+// requested.
+//
+func tagBundleImage(image *BundleImage, options *LoadOptions) error {
+	engine := options.Engine
+	primary := image.Tags[0]
+
+	// Check that the image loaded is the one that was saved:
+	id, err := engine.ID(primary)
+	if err != nil {
+		return err
+	}
+	if id != image.ID {
+		log.Warning(
+			"Identifier of image '%s' is '%s', but it was '%s' when the bundle was created",
+			primary,
+			id,
+			image.ID,
+		)
+	}
+
+	// Restore the tags that aren't stored in the archive, and add
+	// the tags for the target registry:
+	tags := image.Tags
+	if options.Registry != "" {
+		tags = make([]string, len(image.Tags))
+		for i, tag := range image.Tags {
+			tags[i] = replaceRegistry(tag, options.Registry)
+		}
+	}
+	for _, tag := range tags {
+		if tag == primary {
+			continue
+		}
+		err = engine.Tag(primary, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Push the image, if requested:
+	if options.Push {
+		for _, tag := range tags {
+			log.Info("Pushing tag '%s'", tag)
+			err = engine.Push(tag)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeFile writes the content of the given reader to the file with the
+// given path.
+//
+func writeFile(path string, in io.Reader) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, in)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// replaceRegistry replaces the registry of the given tag with the given
+// registry, or adds it if the tag doesn't have a registry. As in the
+// container engines, the first part of the tag is considered a registry
+// if it contains a dot or a colon, or if it is 'localhost'.
+//
+func replaceRegistry(tag, registry string) string {
+	slash := strings.Index(tag, "/")
+	if slash != -1 {
+		first := tag[0:slash]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			tag = tag[slash+1:]
+		}
+	}
+	return strings.TrimSuffix(registry, "/") + "/" + tag
+}
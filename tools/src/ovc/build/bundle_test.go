@@ -0,0 +1,206 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplaceRegistry(t *testing.T) {
+	tests := []struct {
+		tag      string
+		expected string
+	}{
+		{"ovirt/engine:master", "mirror:5000/ovirt/engine:master"},
+		{"docker.io/ovirt/engine:master", "mirror:5000/ovirt/engine:master"},
+		{"localhost/ovirt/engine:master", "mirror:5000/ovirt/engine:master"},
+		{"registry:5000/ovirt/engine:master", "mirror:5000/ovirt/engine:master"},
+		{"engine:master", "mirror:5000/engine:master"},
+	}
+	for _, test := range tests {
+		actual := replaceRegistry(test.tag, "mirror:5000/")
+		if actual != test.expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", test.expected, test.tag, actual)
+		}
+	}
+}
+
+func TestReplaceImageReferences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manifest := filepath.Join(dir, "deployment.yaml")
+	err = ioutil.WriteFile(manifest, []byte(""+
+		"- image: ovirt/engine:master\n"+
+		"- image: ovirt/engine:master-debug\n"+
+		"- image: ovirt/engine-database:master\n"+
+		"- image: centos:7\n"+
+		"- image: quay.io/ovirt/engine:master\n"+
+		"- image: ovirt/engine:master2\n"+
+		"- image: \"ovirt/engine:master\"\n"+
+		"- image: ovirt/engine:master",
+	), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := &BundleIndex{
+		Images: []*BundleImage{
+			{Name: "engine", Tags: []string{"ovirt/engine:master", "ovirt/engine:master-debug"}},
+			{Name: "engine-database", Tags: []string{"ovirt/engine-database:master"}},
+		},
+	}
+	err = replaceImageReferences(dir, index, "mirror:5000")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	data, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "" +
+		"- image: mirror:5000/ovirt/engine:master\n" +
+		"- image: mirror:5000/ovirt/engine:master-debug\n" +
+		"- image: mirror:5000/ovirt/engine-database:master\n" +
+		"- image: centos:7\n" +
+		"- image: quay.io/ovirt/engine:master\n" +
+		"- image: ovirt/engine:master2\n" +
+		"- image: \"mirror:5000/ovirt/engine:master\"\n" +
+		"- image: mirror:5000/ovirt/engine:master"
+	if string(data) != expected {
+		t.Errorf("Expected manifest:\n%s\nGot:\n%s", expected, data)
+	}
+}
+
+func TestExtractBundleEntryOutside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"../evil", "os-manifests/../../evil", "/evil"} {
+		buffer := new(bytes.Buffer)
+		writer := tar.NewWriter(buffer)
+		err = addTarData(writer, name, []byte("evil"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := tar.NewReader(buffer)
+		header, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = extractBundleEntry(reader, header, filepath.Join(dir, "out"))
+		if err == nil {
+			t.Errorf("Expected an error extracting entry '%s'", name)
+		}
+		_, err = os.Stat(filepath.Join(dir, "evil"))
+		if !os.IsNotExist(err) {
+			t.Errorf("Entry '%s' was extracted outside of the directory", name)
+		}
+	}
+}
+
+func TestVerifyBundleMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Write a bundle that only contains the index, and its metadata
+	// and checksums:
+	index := &BundleIndex{
+		Version: "master",
+		Format:  FormatDockerArchive,
+		Images: []*BundleImage{
+			{
+				Name:    "engine",
+				ID:      "sha256:1234",
+				Tags:    []string{"ovirt/engine:master"},
+				Created: time.Date(2017, 6, 6, 14, 4, 26, 0, time.UTC),
+				Size:    1024,
+				File:    "images/ovirt-engine-master.tar",
+			},
+		},
+		Manifests: "os-manifests",
+	}
+	bundle := filepath.Join(dir, "bundle.tar.gz")
+	err = writeCompressedFile(bundle, CompressionGzip, func(out io.Writer) error {
+		data, err := json.Marshal(index)
+		if err != nil {
+			return err
+		}
+		writer := tar.NewWriter(out)
+		err = addTarData(writer, bundleIndexEntry, data)
+		if err != nil {
+			return err
+		}
+		return writer.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func() {
+		err := writeBundleMetadata(bundle, index, CompressionGzip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = WriteChecksums(dir, []string{bundle, MetadataPath(bundle)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write()
+	listed, err := HasChecksum(dir, "bundle.tar.gz")
+	if err != nil || !listed {
+		t.Fatalf("Expected bundle to be listed in checksums file, got %t, %v", listed, err)
+	}
+	problems, err := VerifyArtifacts(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(problems) > 0 {
+		t.Fatalf("Unexpected problems: %q", problems)
+	}
+
+	// Change the metadata, so that it no longer matches the index of
+	// the bundle:
+	index.Images[0].ID = "sha256:5678"
+	write()
+	problems, err = VerifyArtifacts(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "doesn't match the metadata") {
+		t.Fatalf("Expected one problem about the metadata, got %q", problems)
+	}
+}
@@ -20,6 +20,9 @@ package build
 // evaluation of external commands.
 
 import (
+	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
 	"strings"
 
@@ -31,10 +34,18 @@ import (
 // the standard output and standard error of the calling program.
 //
 func RunCommand(name string, args ...string) error {
+	return runCommand(log.DebugWriter(), log.ErrorWriter(), name, args...)
+}
+
+// runCommand executes the given command and waits till it finishes,
+// redirecting its standard output and standard error to the given
+// writers.
+//
+func runCommand(stdout, stderr io.Writer, name string, args ...string) error {
 	log.Debug("Running command '%s' with arguments '%s'", name, strings.Join(args, " "))
 	command := exec.Command(name, args...)
-	command.Stdout = log.DebugWriter()
-	command.Stderr = log.ErrorWriter()
+	command.Stdout = stdout
+	command.Stderr = stderr
 	return command.Run()
 }
 
@@ -50,3 +61,35 @@ func EvalCommand(name string, args ...string) []byte {
 	}
 	return bytes
 }
+
+// DiffDirectories compares recursively the old and the new directories
+// with the 'diff' command, and writes the differences to the given
+// writer in unified format. A old directory that doesn't exist is
+// treated as if it were empty. The returned flag indicates if there are
+// differences.
+//
+func DiffDirectories(out io.Writer, oldDir, newDir string) (changed bool, err error) {
+	// The diff command fails if one of the directories doesn't
+	// exist, so in that case compare with an empty directory:
+	_, err = os.Stat(oldDir)
+	if os.IsNotExist(err) {
+		oldDir, err = ioutil.TempDir("", "empty")
+		if err != nil {
+			return
+		}
+		defer os.RemoveAll(oldDir)
+	}
+	if err != nil {
+		return
+	}
+
+	// Run the diff command. It exits with code zero if there are no
+	// differences, one if there are differences, and two if there
+	// was a problem:
+	err = runCommand(out, log.ErrorWriter(), "diff", "--recursive", "--unified", "--new-file", oldDir, newDir)
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		changed = true
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,200 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+// This file contains the functions used to compress the files where
+// images are saved, and to decompress them when they are loaded.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// Names of the supported compression algorithms.
+//
+const (
+	CompressionNone  = "none"
+	CompressionGzip  = "gzip"
+	CompressionPgzip = "pgzip"
+	CompressionZstd  = "zstd"
+)
+
+// Names of the supported compression algorithms, in the order used in
+// messages.
+//
+var compressionNames = []string{
+	CompressionGzip,
+	CompressionPgzip,
+	CompressionZstd,
+	CompressionNone,
+}
+
+// CheckCompression checks that the given compression algorithm is
+// supported.
+//
+func CheckCompression(name string) error {
+	for _, supported := range compressionNames {
+		if name == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf(
+		"Unknown compression '%s', should be one of '%s'",
+		name,
+		strings.Join(compressionNames, "', '"),
+	)
+}
+
+// CompressionExtension returns the extension that is added to the name
+// of files compressed with the given algorithm.
+//
+func CompressionExtension(name string) string {
+	switch name {
+	case CompressionGzip, CompressionPgzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// nopCloser is a writer that does nothing when it is closed, used when
+// no compression is requested.
+//
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// NewCompressor creates a writer that compresses the data written to it
+// with the given algorithm and writes the result to the given writer.
+// The 'pgzip' algorithm produces the same format than 'gzip', but uses
+// multiple processors. Closing the returned writer flushes the pending
+// data, but doesn't close the underlying writer.
+//
+func NewCompressor(name string, out io.Writer) (io.WriteCloser, error) {
+	switch name {
+	case CompressionGzip:
+		return gzip.NewWriter(out), nil
+	case CompressionPgzip:
+		return pgzip.NewWriter(out), nil
+	case CompressionZstd:
+		return zstd.NewWriter(out)
+	case CompressionNone:
+		return nopCloser{out}, nil
+	default:
+		return nil, CheckCompression(name)
+	}
+}
+
+// writeCompressedFile creates the file with the given path, and calls
+// the given function to write its content through a compressor that
+// uses the given algorithm. The file is first written with a temporary
+// name, and renamed when complete, so that it is never left half
+// written. The directory that contains the file is created if needed.
+//
+func writeCompressedFile(path, compression string, write func(out io.Writer) error) (err error) {
+	// Create the temporary file, and the directory that contains it
+	// if it doesn't exist yet:
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	// Write the content to the compressor, and the compressor to the
+	// file:
+	compressor, err := NewCompressor(compression, file)
+	if err != nil {
+		return
+	}
+	err = write(compressor)
+	if err != nil {
+		compressor.Close()
+		return
+	}
+	err = compressor.Close()
+	if err != nil {
+		return
+	}
+	err = file.Close()
+	if err != nil {
+		return
+	}
+
+	// Give the file its final name:
+	err = os.Rename(tmp, path)
+	return
+}
+
+// Magic numbers at the beginning of compressed data, used to detect the
+// compression algorithm.
+//
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// NewDecompressor creates a reader that decompresses the data read from
+// the given reader. The compression algorithm is detected from the
+// first bytes of the data, and data that isn't compressed with one of
+// the supported algorithms is returned unchanged. Closing the returned
+// reader doesn't close the underlying reader.
+//
+func NewDecompressor(in io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(in)
+	magic, err := buffered.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(buffered), nil
+	}
+}
@@ -0,0 +1,401 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+// This file contains the types and functions used to build the
+// configuration of the project from multiple layers, remembering where
+// each value came from.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/go-ini/ini"
+
+	"ovc/log"
+)
+
+// Names of the sources of the configuration values, from the lowest to
+// the highest precedence.
+//
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceProfile = "profile"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// The prefix of the names of the environment variables that override
+// configuration values.
+//
+const envPrefix = "OVC_"
+
+// The prefix of the names of the sections that contain profiles.
+//
+const profileSection = "profile"
+
+// The name of the section that contains the values for the templates.
+//
+const valuesSection = "values"
+
+// The text written to the log instead of the values that may contain
+// secrets.
+//
+const maskedValue = "***"
+
+// projectConfig contains the merged configuration of the project, and
+// the source of each of the values.
+//
+type projectConfig struct {
+	file    *ini.File
+	sources map[string]map[string]string
+}
+
+// newProjectConfig creates a configuration that contains the default
+// project data.
+//
+func newProjectConfig() (config *projectConfig, err error) {
+	config = &projectConfig{
+		file:    ini.Empty(),
+		sources: make(map[string]map[string]string),
+	}
+	defaults, err := ini.Load([]byte(defaultProjectData))
+	if err != nil {
+		return
+	}
+	err = config.merge(defaults, sourceDefault)
+	return
+}
+
+// merge copies all the values of the given file to the configuration,
+// overriding the values that already exist.
+//
+func (c *projectConfig) merge(file *ini.File, source string) error {
+	for _, section := range file.Sections() {
+		// Make sure that sections are created even if they are
+		// empty, as the checks for unknown image names depend on
+		// them:
+		_, err := c.file.GetSection(section.Name())
+		if err != nil {
+			_, err = c.file.NewSection(section.Name())
+			if err != nil {
+				return err
+			}
+		}
+		for _, key := range section.Keys() {
+			err := c.set(section.Name(), key.Name(), key.Value(), source)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// set sets the value of a key of the configuration, and remembers its
+// source.
+//
+func (c *projectConfig) set(section, key, value, source string) error {
+	_, err := c.file.Section(section).NewKey(key, value)
+	if err != nil {
+		return err
+	}
+	keys := c.sources[section]
+	if keys == nil {
+		keys = make(map[string]string)
+		c.sources[section] = keys
+	}
+	keys[key] = source
+	return nil
+}
+
+// source returns the source of the value of the given key, or an empty
+// string if the key doesn't exist.
+//
+func (c *projectConfig) source(section, key string) string {
+	return c.sources[section][key]
+}
+
+// applyProfile copies the values of the profile with the given name on
+// top of the configuration. Keys inside profile sections have the form
+// 'SECTION.KEY', for example 'images.registry', or 'KEY' for keys of
+// the global section, for example 'version'. Sections with names that
+// contain a quoted part are written with the quotes, for example
+// 'image "engine".pull'.
+//
+func (c *projectConfig) applyProfile(name string) error {
+	sectionName := fmt.Sprintf("%s \"%s\"", profileSection, name)
+	section, err := c.file.GetSection(sectionName)
+	if err != nil {
+		return fmt.Errorf("Can't find profile '%s'", name)
+	}
+	log.Debug("Applying configuration profile '%s'", name)
+	for _, key := range section.Keys() {
+		target, targetKey, err := splitProfileKey(key.Name())
+		if err != nil {
+			return fmt.Errorf("Key '%s' of profile '%s' isn't valid: %s", key.Name(), name, err)
+		}
+		err = c.set(target, targetKey, key.Value(), sourceProfile)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyEnv overrides the values of the configuration with the values
+// of the environment variables that correspond to them. The name of the
+// variable is the 'OVC_' prefix followed by the names of the section
+// and the key, in upper case and with the characters that aren't
+// letters or digits replaced by underscores. For example, the variable
+// for the 'registry' key of the 'images' section is
+// 'OVC_IMAGES_REGISTRY', and the variable for the global 'version' key
+// is 'OVC_VERSION'. The keys are taken from the schema, including the
+// keys of the sections of the images that are in the images directory
+// of the given project root. Keys of the 'values' section that aren't
+// in the configuration are named after the rest of the variable, in
+// lower case, so 'OVC_VALUES_ADMIN_PASSWORD' sets 'admin_password'.
+//
+func (c *projectConfig) applyEnv(root string) error {
+	seen := make(map[string]bool)
+
+	// Apply first the sections with fixed names, as they may change
+	// the images directory:
+	names := make([]string, 0, len(configSchema))
+	for name := range configSchema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := c.applyEnvSection(name, configSchema[name], seen)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Apply the sections of the images, including the sections
+	// that already exist, as the keys with prefixes are only known
+	// when they are present:
+	dir := c.file.Section("images").Key("directory").String()
+	images, err := imageNames(filepath.Join(root, dir))
+	if err != nil {
+		return err
+	}
+	sections := []string{}
+	for _, image := range images {
+		sections = append(sections, fmt.Sprintf("%s \"%s\"", imageSection, image))
+	}
+	for _, section := range c.file.Sections() {
+		if _, ok := imageSectionName(section.Name()); ok {
+			sections = append(sections, section.Name())
+		}
+	}
+	for _, section := range sections {
+		err = c.applyEnvSection(section, imageSchema, seen)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyEnvSection overrides the values of the keys of the given section
+// with the values of the environment variables. The names of the
+// variables that have already been checked are kept in the seen map.
+//
+func (c *projectConfig) applyEnvSection(section string, schema *sectionSchema, seen map[string]bool) error {
+	// Find the names of the candidate keys, those of the schema and
+	// those that are already in the configuration:
+	keys := []string{}
+	for key := range schema.keys {
+		keys = append(keys, key)
+	}
+	existing, err := c.file.GetSection(section)
+	if err == nil {
+		keys = append(keys, existing.KeyStrings()...)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := envName(section, key)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		value, present := os.LookupEnv(name)
+		if !present {
+			continue
+		}
+		err = c.set(section, key, value, sourceEnv)
+		if err != nil {
+			return err
+		}
+	}
+
+	// In sections that accept any key, the variables that haven't
+	// been matched to an existing key create a new one:
+	if !schema.free {
+		return nil
+	}
+	prefix := envName(section, "") + "_"
+	for _, variable := range os.Environ() {
+		equals := strings.Index(variable, "=")
+		if equals == -1 {
+			continue
+		}
+		name := variable[0:equals]
+		if seen[name] || !strings.HasPrefix(name, prefix) || name == prefix {
+			continue
+		}
+		seen[name] = true
+		key := strings.ToLower(strings.TrimPrefix(name, prefix))
+		err = c.set(section, key, variable[equals+1:], sourceEnv)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyOptions overrides the values of the configuration with the given
+// assignments, in the form 'NAME=VALUE', where the name has the same
+// syntax than the keys of the profiles, for example
+// 'images.registry=localhost:5000'.
+//
+func (c *projectConfig) applyOptions(options []string) error {
+	for _, option := range options {
+		equals := strings.Index(option, "=")
+		if equals == -1 {
+			return fmt.Errorf("Option '%s' should have the form 'NAME=VALUE'", option)
+		}
+		section, key, err := splitProfileKey(option[0:equals])
+		if err != nil {
+			return fmt.Errorf("Option '%s' isn't valid: %s", option, err)
+		}
+		err = c.set(section, key, option[equals+1:], sourceFlag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logSources writes to the debug log the effective value of each key of
+// the configuration, and where it came from. The values of the 'values'
+// section and the values taken from the environment are masked, as they
+// often contain passwords and other secrets, and the log files are
+// usually archived with the rest of the build artifacts.
+//
+func (c *projectConfig) logSources() {
+	for _, section := range c.file.Sections() {
+		if isProfileSection(section.Name()) {
+			continue
+		}
+		for _, key := range section.Keys() {
+			source := c.source(section.Name(), key.Name())
+			value := key.Value()
+			if section.Name() == valuesSection || source == sourceEnv {
+				value = maskedValue
+			}
+			log.Debug(
+				"Configuration key '%s' has value '%s' from %s",
+				keyName(section.Name(), key.Name()),
+				value,
+				source,
+			)
+		}
+	}
+}
+
+// envName returns the name of the environment variable that overrides
+// the given key of the given section.
+//
+func envName(section, key string) string {
+	words := []string{}
+	if section != ini.DEFAULT_SECTION {
+		words = append(words, envWords(section)...)
+	}
+	words = append(words, envWords(key)...)
+	return envPrefix + strings.ToUpper(strings.Join(words, "_"))
+}
+
+// envWords splits the given text into the sequences of letters and
+// digits that it contains.
+//
+func envWords(text string) []string {
+	return strings.FieldsFunc(text, func(char rune) bool {
+		return !unicode.IsLetter(char) && !unicode.IsDigit(char)
+	})
+}
+
+// keyName returns the name of the given key of the given section, in
+// the format used by the keys of the profiles.
+//
+func keyName(section, key string) string {
+	if section == ini.DEFAULT_SECTION {
+		return key
+	}
+	return section + "." + key
+}
+
+// isProfileSection checks if the given section name is the name of a
+// profile section.
+//
+func isProfileSection(name string) bool {
+	return strings.HasPrefix(name, profileSection+" \"")
+}
+
+// splitProfileKey splits the name of a key of a profile into the name
+// of the section and the name of the key inside that section.
+//
+func splitProfileKey(name string) (section, key string, err error) {
+	// Keys without dots belong to the global section:
+	dot := strings.Index(name, ".")
+	if dot == -1 {
+		section = ini.DEFAULT_SECTION
+		key = name
+		return
+	}
+
+	// If the section contains a quoted part then the key starts
+	// after the closing quote, otherwise it starts after the first
+	// dot:
+	quote := strings.Index(name, "\"")
+	if quote != -1 && quote < dot {
+		end := strings.Index(name[quote+1:], "\"")
+		if end == -1 {
+			err = fmt.Errorf("the section name doesn't have a closing quote")
+			return
+		}
+		dot = quote + 1 + end + 1
+		if dot >= len(name) || name[dot] != '.' {
+			err = fmt.Errorf("the section name isn't followed by a dot")
+			return
+		}
+	}
+	section = name[0:dot]
+	key = name[dot+1:]
+	if section == "" || key == "" {
+		err = fmt.Errorf("the section or key name is empty")
+	}
+	return
+}
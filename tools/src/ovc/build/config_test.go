@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestApplyEnv(t *testing.T) {
+	// Create a project root with one image, and a project file that
+	// doesn't contain any of the keys set by the environment:
+	root, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	err = os.MkdirAll(filepath.Join(root, "specs", "engine"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := newProjectConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ini.Load([]byte("[values]\ndatabase.password=file\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.merge(file, sourceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Set the variables, including one that changes the images
+	// directory, so that the image is found:
+	variables := map[string]string{
+		"OVC_IMAGES_DIRECTORY":         "specs",
+		"OVC_TEMPLATES_STRICT":         "true",
+		"OVC_IMAGE_NO_CACHE":           "true",
+		"OVC_IMAGE_ENGINE_PULL":        "true",
+		"OVC_VALUES_DATABASE_PASSWORD": "env",
+		"OVC_VALUES_ADMIN_PASSWORD":    "secret",
+	}
+	for name, value := range variables {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	err = config.applyEnv(root)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		section  string
+		key      string
+		expected string
+	}{
+		{"images", "directory", "specs"},
+		{"templates", "strict", "true"},
+		{"image", "no-cache", "true"},
+		{`image "engine"`, "pull", "true"},
+		{"values", "database.password", "env"},
+		{"values", "admin_password", "secret"},
+	}
+	for _, test := range tests {
+		actual := config.file.Section(test.section).Key(test.key).String()
+		if actual != test.expected {
+			t.Errorf(
+				"Expected value '%s' for key '%s', got '%s'",
+				test.expected, keyName(test.section, test.key), actual,
+			)
+		}
+		source := config.source(test.section, test.key)
+		if source != sourceEnv {
+			t.Errorf(
+				"Expected source '%s' for key '%s', got '%s'",
+				sourceEnv, keyName(test.section, test.key), source,
+			)
+		}
+	}
+	err = config.validate()
+	if err != nil {
+		t.Errorf("Unexpected validation error: %s", err)
+	}
+}
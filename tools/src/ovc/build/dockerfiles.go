@@ -17,66 +17,590 @@ limitations under the License.
 package build
 
 // This file contains types useful to load and manipulate docker files.
+//
+// The parser follows the Dockerfile reference: it understands parser
+// directives, line continuations using the escape character, comment
+// lines, the JSON array form of instructions, heredocs, flags like
+// '--from=...', and the substitution of the ARG instructions that
+// appear before the first FROM instruction. Heredocs are always
+// recognized in the RUN, COPY and ADD instructions, as BuildKit, buildah
+// and podman support them even without a 'syntax' parser directive.
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"regexp"
+	"strconv"
 	"strings"
+	"unicode"
 )
 
-// Instruction represents each of the instructions that form an
-// Dockerfile.
+// DockerfileError is the error returned when a docker file can't be
+// parsed. It contains the name of the file and the line where the
+// problem was detected.
+//
+type DockerfileError struct {
+	// The path of the docker file.
+	Path string
+
+	// The number of the line, starting with 1.
+	Line int
+
+	// The description of the problem.
+	Message string
+}
+
+// Error returns the text of the error, including the path and the line
+// number.
+//
+func (e *DockerfileError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Message)
+}
+
+// DockerfileHeredoc contains the description of a heredoc that is
+// part of an instruction, for example:
+//
+//	RUN <<EOF
+//	yum -y install ovirt-engine
+//	EOF
+//
+type DockerfileHeredoc struct {
+	// The name of the heredoc, 'EOF' in the above example.
+	Name string
+
+	// The content of the heredoc, not including the line that
+	// contains the name.
+	Content string
+
+	// Indicates if the leading tabs should be removed, using the
+	// '<<-' syntax.
+	Chomp bool
+
+	// Indicates if variables inside the content should be expanded.
+	// It is false when the name is quoted.
+	Expand bool
+}
+
+// DockerfileInstruction represents each of the instructions that form
+// an Dockerfile.
 //
 type DockerfileInstruction struct {
-	// The name of the instruction.
+	// The name of the instruction, always in upper case.
 	Name string
 
-	// The arguments of the instruction.
+	// The arguments of the instruction, with the line continuations
+	// removed, but otherwise as they appear in the file.
 	Args string
+
+	// The number of the first and last lines of the instruction,
+	// starting with 1.
+	Line    int
+	EndLine int
+
+	// The flags that appear at the beginning of the arguments, for
+	// example '--from=builder', indexed by name without the leading
+	// dashes. Flags like '--mount' can appear multiple times, so
+	// each name has a slice of values.
+	Flags map[string][]string
+
+	// The arguments of the instruction, not including the flags,
+	// split in words. If the instruction uses the JSON array form
+	// then these are the items of the array.
+	Words []string
+
+	// Indicates if the instruction uses the JSON array form.
+	JSON bool
+
+	// The heredocs used by the instruction.
+	Heredocs []*DockerfileHeredoc
+}
+
+// Flag returns the value of the given flag of the instruction, and a
+// boolean indicating if the flag is present. If the flag appears
+// multiple times the last value is returned.
+//
+func (i *DockerfileInstruction) Flag(name string) (value string, present bool) {
+	values := i.Flags[name]
+	if len(values) == 0 {
+		return
+	}
+	value = values[len(values)-1]
+	present = true
+	return
+}
+
+// DockerfileStage contains the description of one of the stages of a
+// multi-stage docker file. Each stage starts with a FROM instruction.
+//
+type DockerfileStage struct {
+	// The position of the stage inside the docker file, starting
+	// with zero.
+	Index int
+
+	// The name of the stage, as given with 'AS name' in the FROM
+	// instruction, or an empty string if it isn't given.
+	Name string
+
+	// The base of the stage, with the build arguments replaced by
+	// their values. It can be an image or the name of a previous
+	// stage.
+	Base string
+
+	// The instructions of the stage, including the FROM instruction.
+	Instructions []*DockerfileInstruction
 }
 
 // Dockerfile conatins the information extracted from o docker file.
 //
 type Dockerfile struct {
+	path         string
+	escape       rune
+	directives   map[string]string
 	instructions []*DockerfileInstruction
+	args         map[string]string
 }
 
 // NewDockerfile creates a new empty docker file.
 //
 func NewDockerfile() *Dockerfile {
-	return new(Dockerfile)
+	d := new(Dockerfile)
+	d.escape = '\\'
+	d.directives = make(map[string]string)
+	d.instructions = make([]*DockerfileInstruction, 0)
+	d.args = make(map[string]string)
+	return d
+}
+
+// Names of the instructions supported in docker files.
+//
+var dockerfileInstructions = map[string]bool{
+	"ADD":         true,
+	"ARG":         true,
+	"CMD":         true,
+	"COPY":        true,
+	"ENTRYPOINT":  true,
+	"ENV":         true,
+	"EXPOSE":      true,
+	"FROM":        true,
+	"HEALTHCHECK": true,
+	"LABEL":       true,
+	"MAINTAINER":  true,
+	"ONBUILD":     true,
+	"RUN":         true,
+	"SHELL":       true,
+	"STOPSIGNAL":  true,
+	"USER":        true,
+	"VOLUME":      true,
+	"WORKDIR":     true,
+}
+
+// Names of the instructions that support the JSON array form.
+//
+var dockerfileJSONInstructions = map[string]bool{
+	"ADD":        true,
+	"CMD":        true,
+	"COPY":       true,
+	"ENTRYPOINT": true,
+	"RUN":        true,
+	"SHELL":      true,
+	"VOLUME":     true,
+}
+
+// Names of the instructions that support heredocs.
+//
+var dockerfileHeredocInstructions = map[string]bool{
+	"ADD":  true,
+	"COPY": true,
+	"RUN":  true,
+}
+
+// Names of the supported parser directives.
+//
+var dockerfileDirectives = map[string]bool{
+	"check":  true,
+	"escape": true,
+	"syntax": true,
 }
 
 // Load loads a docker file and builds a list of structures containing
-// the instruction names and arguments.
+// the instruction names and arguments. If the file can't be read it
+// returns the error generated by the operating system, and if it can't
+// be parsed it returns a *DockerfileError.
 //
-func (d *Dockerfile) Load(path string) *Dockerfile {
-	d.instructions = make([]*DockerfileInstruction, 0)
-	bytes, err := ioutil.ReadFile(path)
+func (d *Dockerfile) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return d.Parse(path, data)
+}
+
+// Parse parses the given docker file content. The path is only used to
+// generate error messages.
+//
+func (d *Dockerfile) Parse(path string, data []byte) error {
+	d.path = path
+
+	// Split the text into lines, removing the line terminators:
+	lines := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSuffix(scanner.Text(), "\r"))
+	}
+	err := scanner.Err()
 	if err != nil {
-		panic(err)
-	}
-	text := string(bytes)
-	text = continueRe.ReplaceAllString(text, "")
-	lines := strings.Split(text, "\n")
-	for _, line := range lines {
-		line = commentRe.ReplaceAllString(line, "")
-		if line == "" {
+		return err
+	}
+
+	// Process the parser directives, which can only appear at the
+	// beginning of the file:
+	index := 0
+	for index < len(lines) {
+		name, value, ok := parseDirective(lines[index])
+		if !ok {
+			break
+		}
+		if _, present := d.directives[name]; present {
+			return d.error(index+1, "Parser directive '%s' appears more than once", name)
+		}
+		d.directives[name] = value
+		index++
+		if name != "escape" {
 			continue
 		}
-		groups := FindRegexpGroups(line, instructionRe)
-		if groups == nil {
+		switch value {
+		case "\\":
+			d.escape = '\\'
+		case "`":
+			d.escape = '`'
+		default:
+			return d.error(index, "Invalid escape character '%s', should be '\\' or '`'", value)
+		}
+	}
+
+	// Process the instructions:
+	for index < len(lines) {
+		line := lines[index]
+		if isBlankLine(line) || isCommentLine(line) {
+			index++
 			continue
 		}
-		name := groups["name"]
-		args := groups["args"]
-		instruction := &DockerfileInstruction{
-			Name: name,
-			Args: args,
+		index, err = d.parseInstruction(lines, index)
+		if err != nil {
+			return err
 		}
-		d.instructions = append(d.instructions, instruction)
 	}
-	return d
+
+	// Collect the default values of the ARG instructions that
+	// appear before the first FROM, as those can be used in the
+	// FROM instructions:
+	for _, instruction := range d.instructions {
+		if instruction.Name == "FROM" {
+			break
+		}
+		if instruction.Name != "ARG" {
+			continue
+		}
+		for _, word := range instruction.Words {
+			name := word
+			value := ""
+			equals := strings.Index(word, "=")
+			if equals >= 0 {
+				name = word[0:equals]
+				value = unquote(word[equals+1:])
+			}
+			if _, present := d.args[name]; !present || equals >= 0 {
+				d.args[name] = value
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseInstruction parses the instruction that starts in the given
+// line, including the continuation lines and the heredocs. It returns
+// the index of the first line after the instruction.
+//
+func (d *Dockerfile) parseInstruction(lines []string, index int) (next int, err error) {
+	first := index
+
+	// Join the continuation lines. Comment lines and blank lines in
+	// the middle of an instruction are ignored.
+	buffer := new(bytes.Buffer)
+	for index < len(lines) {
+		line := lines[index]
+		index++
+		if index-1 > first && (isBlankLine(line) || isCommentLine(line)) {
+			continue
+		}
+		trimmed := strings.TrimRightFunc(line, unicode.IsSpace)
+		if strings.HasSuffix(trimmed, string(d.escape)) {
+			buffer.WriteString(strings.TrimSuffix(trimmed, string(d.escape)))
+			continue
+		}
+		buffer.WriteString(line)
+		break
+	}
+	text := strings.TrimSpace(buffer.String())
+
+	// Split the name and the arguments:
+	name := text
+	args := ""
+	space := strings.IndexFunc(text, unicode.IsSpace)
+	if space >= 0 {
+		name = text[0:space]
+		args = strings.TrimSpace(text[space:])
+	}
+	instruction := &DockerfileInstruction{
+		Name:  strings.ToUpper(name),
+		Args:  args,
+		Line:  first + 1,
+		Flags: make(map[string][]string),
+	}
+	if !dockerfileInstructions[instruction.Name] {
+		err = d.error(first+1, "Unknown instruction '%s'", name)
+		return
+	}
+	if args == "" {
+		err = d.error(first+1, "Instruction '%s' requires at least one argument", instruction.Name)
+		return
+	}
+
+	// Extract the flags:
+	rest := args
+	for strings.HasPrefix(rest, "--") {
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			end = len(rest)
+		}
+		flag := rest[2:end]
+		value := ""
+		equals := strings.Index(flag, "=")
+		if equals >= 0 {
+			value = flag[equals+1:]
+			flag = flag[0:equals]
+		}
+		instruction.Flags[flag] = append(instruction.Flags[flag], value)
+		rest = strings.TrimSpace(rest[end:])
+	}
+
+	// Check if the arguments use the JSON array form. If they look
+	// like an array but they aren't valid JSON then they are
+	// processed as the shell form, like docker does.
+	if dockerfileJSONInstructions[instruction.Name] && strings.HasPrefix(rest, "[") {
+		var items []string
+		if json.Unmarshal([]byte(rest), &items) == nil {
+			instruction.JSON = true
+			instruction.Words = items
+		}
+	}
+	if !instruction.JSON {
+		instruction.Words = splitWords(rest)
+	}
+
+	// Read the content of the heredocs, which starts in the line
+	// after the instruction:
+	if dockerfileHeredocInstructions[instruction.Name] && !instruction.JSON {
+		for _, word := range instruction.Words {
+			heredoc := parseHeredoc(word)
+			if heredoc == nil {
+				continue
+			}
+			index, err = d.readHeredoc(lines, index, heredoc)
+			if err != nil {
+				return
+			}
+			instruction.Heredocs = append(instruction.Heredocs, heredoc)
+		}
+	}
+
+	instruction.EndLine = index
+	d.instructions = append(d.instructions, instruction)
+	next = index
+	return
+}
+
+// readHeredoc reads the content of a heredoc starting at the given line
+// and returns the index of the line after the terminator.
+//
+func (d *Dockerfile) readHeredoc(lines []string, index int, heredoc *DockerfileHeredoc) (next int, err error) {
+	start := index
+	buffer := new(bytes.Buffer)
+	for index < len(lines) {
+		line := lines[index]
+		index++
+		if heredoc.Chomp {
+			line = strings.TrimLeft(line, "\t")
+		}
+		if line == heredoc.Name {
+			heredoc.Content = buffer.String()
+			next = index
+			return
+		}
+		buffer.WriteString(line)
+		buffer.WriteString("\n")
+	}
+	err = d.error(start, "Heredoc '%s' isn't terminated", heredoc.Name)
+	return
+}
+
+// parseHeredoc checks if the given word starts a heredoc, like '<<EOF',
+// '<<-EOF' or '<<"EOF"', and returns its description, or nil if it
+// doesn't.
+//
+func parseHeredoc(word string) *DockerfileHeredoc {
+	if !strings.HasPrefix(word, "<<") {
+		return nil
+	}
+	heredoc := new(DockerfileHeredoc)
+	name := word[2:]
+	if strings.HasPrefix(name, "-") {
+		heredoc.Chomp = true
+		name = name[1:]
+	}
+	heredoc.Expand = true
+	if len(name) >= 2 && (name[0] == '"' || name[0] == '\'') && name[len(name)-1] == name[0] {
+		heredoc.Expand = false
+		name = name[1 : len(name)-1]
+	}
+	if name == "" {
+		return nil
+	}
+	for _, char := range name {
+		if !unicode.IsLetter(char) && !unicode.IsDigit(char) && char != '_' {
+			return nil
+		}
+	}
+	heredoc.Name = name
+	return heredoc
+}
+
+// parseDirective checks if the given line is a parser directive, like
+// '# escape=`', and returns its name, in lower case, and its value.
+//
+func parseDirective(line string) (name, value string, ok bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "#") {
+		return
+	}
+	line = strings.TrimSpace(line[1:])
+	equals := strings.Index(line, "=")
+	if equals < 0 {
+		return
+	}
+	name = strings.ToLower(strings.TrimSpace(line[0:equals]))
+	value = strings.TrimSpace(line[equals+1:])
+	ok = dockerfileDirectives[name]
+	return
+}
+
+// isBlankLine checks if the given line contains only white space.
+//
+func isBlankLine(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// isCommentLine checks if the given line is a comment. Note that only
+// lines where the first character that isn't white space is '#' are
+// comments, a '#' in the middle of a line is part of the arguments of
+// the instruction.
+//
+func isCommentLine(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "#")
+}
+
+// splitWords splits the given text in words separated by white space,
+// keeping together the text inside single or double quotes.
+//
+func splitWords(text string) []string {
+	words := []string{}
+	word := new(bytes.Buffer)
+	inWord := false
+	var quote rune
+	for _, char := range text {
+		switch {
+		case quote != 0:
+			word.WriteRune(char)
+			if char == quote {
+				quote = 0
+			}
+		case char == '"' || char == '\'':
+			word.WriteRune(char)
+			quote = char
+			inWord = true
+		case unicode.IsSpace(char):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(char)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// unquote removes the quotes that surround the given text, if any.
+//
+func unquote(text string) string {
+	if len(text) >= 2 && (text[0] == '"' || text[0] == '\'') && text[len(text)-1] == text[0] {
+		return text[1 : len(text)-1]
+	}
+	return text
+}
+
+// error creates a new error for the given line of the docker file.
+//
+func (d *Dockerfile) error(line int, format string, args ...interface{}) error {
+	return &DockerfileError{
+		Path:    d.path,
+		Line:    line,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Path returns the path of the docker file.
+//
+func (d *Dockerfile) Path() string {
+	return d.path
+}
+
+// Directives returns the parser directives of the docker file, indexed
+// by name, in lower case.
+//
+func (d *Dockerfile) Directives() map[string]string {
+	return d.directives
+}
+
+// Instructions returns the instructions of the docker file, in the
+// order that they appear in the file.
+//
+func (d *Dockerfile) Instructions() []*DockerfileInstruction {
+	return d.instructions
+}
+
+// Args returns the build arguments declared with ARG instructions
+// before the first FROM instruction, with their default values. Those
+// are the arguments that can be used in FROM instructions.
+//
+func (d *Dockerfile) Args() map[string]string {
+	return d.args
+}
+
+// SetArg sets the value of a build argument, overriding the default
+// value given in the docker file.
+//
+func (d *Dockerfile) SetArg(name, value string) {
+	d.args[name] = value
 }
 
 // Instruction finds the first instruction within the given Dockerfile
@@ -84,6 +608,7 @@ func (d *Dockerfile) Load(path string) *Dockerfile {
 // returns nil.
 //
 func (d *Dockerfile) Instruction(name string) *DockerfileInstruction {
+	name = strings.ToUpper(name)
 	for _, instruction := range d.instructions {
 		if instruction.Name == name {
 			return instruction
@@ -93,21 +618,229 @@ func (d *Dockerfile) Instruction(name string) *DockerfileInstruction {
 }
 
 // From finds the first FROM instruction within a Dockerfile. If that
-// instruction exists then it returns its arguments. If it doesn't exist
+// instruction exists then it returns the name of the base image, with
+// the build arguments replaced by their values. If it doesn't exist
 // then it returns an empty string.
 //
 func (d *Dockerfile) From() string {
 	from := d.Instruction("FROM")
-	if from == nil {
+	if from == nil || len(from.Words) == 0 {
+		return ""
+	}
+	image, err := d.Expand(from.Words[0])
+	if err != nil {
 		return ""
 	}
-	return from.Args
+	return image
 }
 
-// Regular expressions used to process docker files.
+// Stages returns the stages of the docker file, in the order that they
+// appear in the file. Instructions that appear before the first FROM
+// instruction, like the ARG instructions used to parametrize it, aren't
+// part of any stage.
 //
-var (
-	commentRe     = regexp.MustCompile("\\s*#.*$")
-	continueRe    = regexp.MustCompile("\\\\\n")
-	instructionRe = regexp.MustCompile("^\\s*(?P<name>[a-zA-Z]+)\\s+(?P<args>.*)$")
-)
+func (d *Dockerfile) Stages() (stages []*DockerfileStage, err error) {
+	var current *DockerfileStage
+	for _, instruction := range d.instructions {
+		if instruction.Name == "FROM" {
+			current, err = d.newStage(len(stages), instruction)
+			if err != nil {
+				return
+			}
+			stages = append(stages, current)
+		}
+		if current != nil {
+			current.Instructions = append(current.Instructions, instruction)
+		}
+	}
+	return
+}
+
+// newStage creates a stage from the given FROM instruction.
+//
+func (d *Dockerfile) newStage(index int, from *DockerfileInstruction) (stage *DockerfileStage, err error) {
+	words := from.Words
+	if len(words) != 1 && (len(words) != 3 || strings.ToUpper(words[1]) != "AS") {
+		err = d.error(from.Line, "Instruction 'FROM' should have the form 'FROM image [AS name]'")
+		return
+	}
+	stage = &DockerfileStage{
+		Index: index,
+	}
+	stage.Base, err = d.Expand(words[0])
+	if err != nil {
+		err = d.error(from.Line, "%s", err)
+		return
+	}
+	if len(words) == 3 {
+		stage.Name = strings.ToLower(words[2])
+	}
+	return
+}
+
+// References returns the images that the docker file refers to, either
+// as the base of a stage, or with the '--from' flag of the COPY and
+// ADD instructions, or with the 'from' option of the '--mount' flag of
+// the RUN instruction. References to previous stages, by name or by
+// index, aren't included. Each image appears only once, in the order
+// of the first reference.
+//
+func (d *Dockerfile) References() (images []string, err error) {
+	stages, err := d.Stages()
+	if err != nil {
+		return
+	}
+	names := make(map[string]bool)
+	seen := make(map[string]bool)
+	add := func(reference string) {
+		if names[strings.ToLower(reference)] || seen[reference] {
+			return
+		}
+		seen[reference] = true
+		images = append(images, reference)
+	}
+	for _, stage := range stages {
+		if stage.Base != "scratch" {
+			add(stage.Base)
+		}
+		for _, instruction := range stage.Instructions {
+			for _, from := range instructionSources(instruction) {
+				var expanded string
+				expanded, err = d.Expand(from)
+				if err != nil {
+					err = d.error(instruction.Line, "%s", err)
+					return
+				}
+				if isStageIndex(expanded, stage.Index) {
+					continue
+				}
+				add(expanded)
+			}
+		}
+		if stage.Name != "" {
+			names[stage.Name] = true
+		}
+	}
+	return
+}
+
+// instructionSources returns the values of the '--from' flag of an
+// instruction, and of the 'from' options of its '--mount' flag.
+//
+func instructionSources(instruction *DockerfileInstruction) []string {
+	sources := []string{}
+	switch instruction.Name {
+	case "COPY", "ADD":
+		from, present := instruction.Flag("from")
+		if present && from != "" {
+			sources = append(sources, from)
+		}
+	case "RUN":
+		for _, mount := range instruction.Flags["mount"] {
+			for _, option := range strings.Split(mount, ",") {
+				if strings.HasPrefix(option, "from=") {
+					sources = append(sources, strings.TrimPrefix(option, "from="))
+				}
+			}
+		}
+	}
+	return sources
+}
+
+// isStageIndex checks if the given text is the index of one of the
+// stages before the given one.
+//
+func isStageIndex(text string, current int) bool {
+	index, err := strconv.Atoi(text)
+	return err == nil && index >= 0 && index < current
+}
+
+// Expand replaces the references to build arguments in the given text,
+// like '$NAME', '${NAME}', '${NAME:-default}' or '${NAME:+alternative}',
+// with their values. The escape character can be used to prevent the
+// expansion of a dollar sign.
+//
+func (d *Dockerfile) Expand(text string) (string, error) {
+	buffer := new(bytes.Buffer)
+	chars := []rune(text)
+	for i := 0; i < len(chars); i++ {
+		char := chars[i]
+		switch {
+		case char == d.escape && i+1 < len(chars) && chars[i+1] == '$':
+			buffer.WriteRune('$')
+			i++
+		case char == '$' && i+1 < len(chars) && chars[i+1] == '{':
+			end := i + 2
+			for end < len(chars) && chars[end] != '}' {
+				end++
+			}
+			if end == len(chars) {
+				return "", fmt.Errorf("Missing '}' in '%s'", text)
+			}
+			value, err := d.expandBraces(string(chars[i+2 : end]))
+			if err != nil {
+				return "", err
+			}
+			buffer.WriteString(value)
+			i = end
+		case char == '$' && i+1 < len(chars) && isNameChar(chars[i+1]):
+			end := i + 1
+			for end < len(chars) && isNameChar(chars[end]) {
+				end++
+			}
+			buffer.WriteString(d.args[string(chars[i+1:end])])
+			i = end - 1
+		default:
+			buffer.WriteRune(char)
+		}
+	}
+	return buffer.String(), nil
+}
+
+// expandBraces calculates the value of an expression inside '${...}'.
+//
+func (d *Dockerfile) expandBraces(expr string) (string, error) {
+	end := 0
+	for end < len(expr) && isNameChar(rune(expr[end])) {
+		end++
+	}
+	name := expr[0:end]
+	modifier := expr[end:]
+	if name == "" {
+		return "", fmt.Errorf("Bad substitution '${%s}'", expr)
+	}
+	value, present := d.args[name]
+	switch {
+	case modifier == "":
+		return value, nil
+	case strings.HasPrefix(modifier, ":-"):
+		if value == "" {
+			return d.Expand(modifier[2:])
+		}
+		return value, nil
+	case strings.HasPrefix(modifier, ":+"):
+		if value != "" {
+			return d.Expand(modifier[2:])
+		}
+		return "", nil
+	case strings.HasPrefix(modifier, "-"):
+		if !present {
+			return d.Expand(modifier[1:])
+		}
+		return value, nil
+	case strings.HasPrefix(modifier, "+"):
+		if present {
+			return d.Expand(modifier[1:])
+		}
+		return "", nil
+	default:
+		return "", fmt.Errorf("Unsupported modifier in '${%s}'", expr)
+	}
+}
+
+// isNameChar checks if the given character can be part of the name of
+// a variable.
+//
+func isNameChar(char rune) bool {
+	return char == '_' || unicode.IsLetter(char) || unicode.IsDigit(char)
+}
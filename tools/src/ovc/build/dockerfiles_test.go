@@ -0,0 +1,326 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseDockerfile parses the given lines as the content of a docker
+// file.
+//
+func parseDockerfile(lines ...string) (dockerfile *Dockerfile, err error) {
+	dockerfile = NewDockerfile()
+	err = dockerfile.Parse("Dockerfile", []byte(strings.Join(lines, "\n")+"\n"))
+	return
+}
+
+func TestDockerfileInstructions(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		words [][]string
+		json  []bool
+	}{
+		{
+			name: "Backslash continuation",
+			lines: []string{
+				"FROM centos:7",
+				"RUN yum -y install \\",
+				"    ovirt-engine",
+			},
+			words: [][]string{
+				{"centos:7"},
+				{"yum", "-y", "install", "ovirt-engine"},
+			},
+			json: []bool{false, false},
+		},
+		{
+			name: "Backtick escape directive",
+			lines: []string{
+				"# escape=`",
+				"FROM centos:7",
+				"RUN dir c:\\ `",
+				"    /b",
+			},
+			words: [][]string{
+				{"centos:7"},
+				{"dir", "c:\\", "/b"},
+			},
+			json: []bool{false, false},
+		},
+		{
+			name: "JSON form",
+			lines: []string{
+				"FROM centos:7",
+				`CMD ["/usr/bin/engine", "--debug"]`,
+				`ENTRYPOINT ["broken"`,
+			},
+			words: [][]string{
+				{"centos:7"},
+				{"/usr/bin/engine", "--debug"},
+				{`["broken"`},
+			},
+			json: []bool{false, true, false},
+		},
+		{
+			name: "Hash inside quoted argument",
+			lines: []string{
+				"FROM centos:7",
+				`RUN echo "a # b" && echo 'c # d'`,
+				"# This is a comment",
+				`LABEL description="Image # 1"`,
+			},
+			words: [][]string{
+				{"centos:7"},
+				{"echo", `"a # b"`, "&&", "echo", "'c # d'"},
+				{`description="Image # 1"`},
+			},
+			json: []bool{false, false, false},
+		},
+		{
+			name: "Comment inside continuation",
+			lines: []string{
+				"FROM centos:7",
+				"RUN yum -y install \\",
+				"# ovirt-engine-extra \\",
+				"    ovirt-engine",
+			},
+			words: [][]string{
+				{"centos:7"},
+				{"yum", "-y", "install", "ovirt-engine"},
+			},
+			json: []bool{false, false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dockerfile, err := parseDockerfile(test.lines...)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			instructions := dockerfile.Instructions()
+			if len(instructions) != len(test.words) {
+				t.Fatalf("Expected %d instructions, got %d", len(test.words), len(instructions))
+			}
+			for i, instruction := range instructions {
+				if !reflect.DeepEqual(instruction.Words, test.words[i]) {
+					t.Errorf("Expected words %q for instruction %d, got %q", test.words[i], i, instruction.Words)
+				}
+				if instruction.JSON != test.json[i] {
+					t.Errorf("Expected JSON %t for instruction %d, got %t", test.json[i], i, instruction.JSON)
+				}
+			}
+		})
+	}
+}
+
+func TestDockerfileHeredocs(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		heredocs []string
+		count    int
+	}{
+		{
+			name: "Enabled by syntax directive",
+			lines: []string{
+				"# syntax=docker/dockerfile:1",
+				"FROM centos:7",
+				"RUN <<EOF",
+				"yum -y install ovirt-engine",
+				"EOF",
+			},
+			heredocs: []string{"yum -y install ovirt-engine\n"},
+			count:    2,
+		},
+		{
+			name: "Chomp leading tabs",
+			lines: []string{
+				"# syntax=docker/dockerfile:1",
+				"FROM centos:7",
+				"RUN <<-EOF",
+				"\techo hello",
+				"\tEOF",
+			},
+			heredocs: []string{"echo hello\n"},
+			count:    2,
+		},
+		{
+			name: "Without syntax directive",
+			lines: []string{
+				"FROM centos:7",
+				"RUN cat <<EOF > /etc/motd",
+				"ENV NAME=value",
+				"EOF",
+				"ENV NAME=value",
+			},
+			heredocs: []string{"ENV NAME=value\n"},
+			count:    3,
+		},
+		{
+			name: "Ignored in JSON form",
+			lines: []string{
+				"FROM centos:7",
+				`RUN ["cat", "<<EOF"]`,
+				"ENV NAME=value",
+			},
+			heredocs: nil,
+			count:    3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dockerfile, err := parseDockerfile(test.lines...)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			instructions := dockerfile.Instructions()
+			if len(instructions) != test.count {
+				t.Fatalf("Expected %d instructions, got %d", test.count, len(instructions))
+			}
+			var contents []string
+			for _, heredoc := range dockerfile.Instruction("RUN").Heredocs {
+				contents = append(contents, heredoc.Content)
+			}
+			if !reflect.DeepEqual(contents, test.heredocs) {
+				t.Errorf("Expected heredocs %q, got %q", test.heredocs, contents)
+			}
+		})
+	}
+}
+
+func TestDockerfileArgsBeforeFrom(t *testing.T) {
+	dockerfile, err := parseDockerfile(
+		"ARG REGISTRY=docker.io",
+		"ARG VERSION",
+		"FROM ${REGISTRY}/centos:${VERSION:-7}",
+		"ARG INSIDE=ignored",
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := map[string]string{
+		"REGISTRY": "docker.io",
+		"VERSION":  "",
+	}
+	if !reflect.DeepEqual(dockerfile.Args(), expected) {
+		t.Errorf("Expected args %v, got %v", expected, dockerfile.Args())
+	}
+	from := dockerfile.From()
+	if from != "docker.io/centos:7" {
+		t.Errorf("Expected base image 'docker.io/centos:7', got '%s'", from)
+	}
+	dockerfile.SetArg("VERSION", "8")
+	from = dockerfile.From()
+	if from != "docker.io/centos:8" {
+		t.Errorf("Expected base image 'docker.io/centos:8', got '%s'", from)
+	}
+}
+
+func TestDockerfileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		line    int
+		message string
+	}{
+		{
+			name: "Unknown instruction",
+			lines: []string{
+				"FROM centos:7",
+				"",
+				"RUNN echo hello",
+			},
+			line:    3,
+			message: "Unknown instruction 'RUNN'",
+		},
+		{
+			name: "Unknown instruction after continuation",
+			lines: []string{
+				"FROM centos:7",
+				"RUN echo \\",
+				"    hello",
+				"COPYY a b",
+			},
+			line:    4,
+			message: "Unknown instruction 'COPYY'",
+		},
+		{
+			name: "Missing arguments",
+			lines: []string{
+				"FROM centos:7",
+				"WORKDIR",
+			},
+			line:    2,
+			message: "Instruction 'WORKDIR' requires at least one argument",
+		},
+		{
+			name: "Invalid escape",
+			lines: []string{
+				"# syntax=docker/dockerfile:1",
+				"# escape=x",
+				"FROM centos:7",
+			},
+			line:    2,
+			message: "Invalid escape character 'x', should be '\\' or '`'",
+		},
+		{
+			name: "Repeated directive",
+			lines: []string{
+				"# escape=`",
+				"# escape=\\",
+				"FROM centos:7",
+			},
+			line:    2,
+			message: "Parser directive 'escape' appears more than once",
+		},
+		{
+			name: "Unterminated heredoc",
+			lines: []string{
+				"FROM centos:7",
+				"RUN <<EOF",
+				"echo hello",
+			},
+			line:    2,
+			message: "Heredoc 'EOF' isn't terminated",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseDockerfile(test.lines...)
+			if err == nil {
+				t.Fatalf("Expected an error, but parsing succeeded")
+			}
+			dockerfileErr, ok := err.(*DockerfileError)
+			if !ok {
+				t.Fatalf("Expected a *DockerfileError, got %T: %s", err, err)
+			}
+			if dockerfileErr.Line != test.line {
+				t.Errorf("Expected error in line %d, got line %d", test.line, dockerfileErr.Line)
+			}
+			if dockerfileErr.Message != test.message {
+				t.Errorf("Expected message '%s', got '%s'", test.message, dockerfileErr.Message)
+			}
+			if !strings.HasPrefix(err.Error(), "Dockerfile:") {
+				t.Errorf("Expected error to start with the file name, got '%s'", err)
+			}
+		})
+	}
+}
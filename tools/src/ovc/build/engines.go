@@ -0,0 +1,394 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+// This file contains the types and functions used to interact with the
+// container engines that build, store and push the images.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"ovc/log"
+)
+
+// BuildOptions contains the parameters used to build an image.
+//
+type BuildOptions struct {
+	// The directory that contains the Dockerfile and the rest of
+	// the files of the image.
+	Directory string
+
+	// The tag that will be assigned to the built image.
+	Tag string
+
+	// The values of the build arguments.
+	Args map[string]string
+
+	// The labels that will be added to the built image.
+	Labels map[string]string
+
+	// The name of the stage of the Dockerfile to build.
+	Target string
+
+	// Indicates if the cache should be ignored.
+	NoCache bool
+
+	// Indicates if base images should always be pulled.
+	Pull bool
+
+	// The writers where the output of the build will be written.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ContainerEngine is the interface implemented by the tools that build,
+// store and push images.
+//
+type ContainerEngine interface {
+	// Name returns the name of the engine, for example 'docker'.
+	Name() string
+
+	// Build builds an image.
+	Build(options *BuildOptions) error
+
+	// Find returns the identifiers of the local images that have
+	// a label with the given name and value.
+	Find(label, value string) ([]string, error)
+
+	// ID returns the identifier of the local image with the given
+	// tag.
+	ID(tag string) (string, error)
+
+	// Created returns the time when the local image with the given
+	// tag was created.
+	Created(tag string) (time.Time, error)
+
+	// Tag adds a tag to a local image.
+	Tag(image, tag string) error
+
+	// Save writes a local image, in docker-archive format, to the
+	// given writer.
+	Save(tag string, out io.Writer) error
+
+	// Load imports into the local storage the images contained in
+	// the given archive file, that may contain multiple images. The
+	// archive can be in docker-archive format, or in OCI format if it
+	// also contains the manifest used by docker.
+	Load(path string) error
+
+	// Push pushes a local image to the registry.
+	Push(tag string) error
+
+	// Remove removes a tag from the local storage.
+	Remove(tag string) error
+}
+
+// Names of the supported container engines, in the order that they
+// are tried when the engine is detected automatically.
+//
+var engineNames = []string{
+	"docker",
+	"podman",
+	"buildah",
+}
+
+// NewContainerEngine creates the container engine with the given name.
+// If the name is empty or 'auto' it uses the first engine that is
+// available in the PATH, or docker if none is available.
+//
+func NewContainerEngine(name string) (engine ContainerEngine, err error) {
+	if name == "" || name == "auto" {
+		name = detectEngine()
+	}
+	switch name {
+	case "docker":
+		engine = NewDockerEngine()
+	case "podman":
+		engine = NewPodmanEngine()
+	case "buildah":
+		engine = NewBuildahEngine()
+	default:
+		err = fmt.Errorf(
+			"Unknown container engine '%s', should be one of '%s' or 'auto'",
+			name,
+			strings.Join(engineNames, "', '"),
+		)
+	}
+	return
+}
+
+// detectEngine returns the name of the first supported engine that is
+// available in the PATH.
+//
+func detectEngine() string {
+	for _, name := range engineNames {
+		path, err := exec.LookPath(name)
+		if err == nil {
+			log.Debug("Detected container engine '%s' in '%s'", name, path)
+			return name
+		}
+	}
+	log.Debug("Can't find any container engine in the PATH, will use 'docker'")
+	return "docker"
+}
+
+// cliEngine contains the implementation of the operations that have
+// the same command line syntax in docker and podman.
+//
+type cliEngine struct {
+	command string
+}
+
+func (e *cliEngine) Name() string {
+	return e.command
+}
+
+func (e *cliEngine) Build(options *BuildOptions) error {
+	args := []string{"build"}
+	args = append(args, buildArgs(options)...)
+	if options.Pull {
+		args = append(args, "--pull")
+	}
+	args = append(args, options.Directory)
+	return runCommand(options.Stdout, options.Stderr, e.command, args...)
+}
+
+func (e *cliEngine) Find(label, value string) (ids []string, err error) {
+	out := EvalCommand(
+		e.command,
+		"images",
+		"--quiet",
+		"--no-trunc",
+		fmt.Sprintf("--filter=label=%s=%s", label, value),
+	)
+	if out == nil {
+		err = fmt.Errorf("Can't list images with label '%s=%s'", label, value)
+		return
+	}
+	ids = strings.Fields(string(out))
+	return
+}
+
+func (e *cliEngine) ID(tag string) (string, error) {
+	return e.inspect(tag, "{{.Id}}")
+}
+
+func (e *cliEngine) Created(tag string) (time.Time, error) {
+	return e.created(tag, "{{.Created}}")
+}
+
+// created evaluates the given format, which should return the creation
+// time in RFC 3339 format, against the description of the local image
+// with the given tag, and parses the result.
+//
+func (e *cliEngine) created(tag, format string) (created time.Time, err error) {
+	out, err := e.inspect(tag, format)
+	if err != nil {
+		return
+	}
+	created, err = time.Parse(time.RFC3339Nano, out)
+	if err != nil {
+		err = fmt.Errorf("Can't parse creation time '%s' of image '%s': %s", out, tag, err)
+	}
+	return
+}
+
+// createdFormat is the template that podman and buildah use to return
+// the creation time of images in RFC 3339 format, as by default they
+// use a different format.
+//
+const createdFormat = `.Format "2006-01-02T15:04:05.999999999Z07:00"`
+
+// inspect evaluates the given format against the description of the
+// local image with the given tag.
+//
+func (e *cliEngine) inspect(tag, format string) (string, error) {
+	out := EvalCommand(
+		e.command,
+		"inspect",
+		"--type=image",
+		fmt.Sprintf("--format=%s", format),
+		tag,
+	)
+	if out == nil {
+		return "", fmt.Errorf("Can't inspect image '%s'", tag)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (e *cliEngine) Tag(image, tag string) error {
+	return RunCommand(e.command, "tag", image, tag)
+}
+
+func (e *cliEngine) Save(tag string, out io.Writer) error {
+	return runCommand(out, log.ErrorWriter(), e.command, "save", tag)
+}
+
+func (e *cliEngine) Load(path string) error {
+	return RunCommand(e.command, "load", fmt.Sprintf("--input=%s", path))
+}
+
+func (e *cliEngine) Push(tag string) error {
+	return RunCommand(e.command, "push", tag)
+}
+
+func (e *cliEngine) Remove(tag string) error {
+	return RunCommand(e.command, "rmi", tag)
+}
+
+// buildArgs converts the given build options into the command line
+// options that are common to all the engines. Arguments and labels are
+// sorted by name, so that the command line is stable.
+//
+func buildArgs(options *BuildOptions) []string {
+	args := []string{
+		fmt.Sprintf("--tag=%s", options.Tag),
+	}
+	for _, name := range sortedKeys(options.Args) {
+		args = append(args, fmt.Sprintf("--build-arg=%s=%s", name, options.Args[name]))
+	}
+	for _, name := range sortedKeys(options.Labels) {
+		args = append(args, fmt.Sprintf("--label=%s=%s", name, options.Labels[name]))
+	}
+	if options.Target != "" {
+		args = append(args, fmt.Sprintf("--target=%s", options.Target))
+	}
+	if options.NoCache {
+		args = append(args, "--no-cache")
+	}
+	return args
+}
+
+// dockerEngine is the container engine that uses the 'docker' command.
+//
+type dockerEngine struct {
+	cliEngine
+}
+
+// NewDockerEngine creates a container engine that uses the 'docker'
+// command.
+//
+func NewDockerEngine() ContainerEngine {
+	e := new(dockerEngine)
+	e.command = "docker"
+	return e
+}
+
+// podmanEngine is the container engine that uses the 'podman' command.
+//
+type podmanEngine struct {
+	cliEngine
+}
+
+// NewPodmanEngine creates a container engine that uses the 'podman'
+// command.
+//
+func NewPodmanEngine() ContainerEngine {
+	e := new(podmanEngine)
+	e.command = "podman"
+	return e
+}
+
+func (e *podmanEngine) Created(tag string) (time.Time, error) {
+	return e.created(tag, "{{.Created"+createdFormat+"}}")
+}
+
+// buildahEngine is the container engine that uses the 'buildah'
+// command. It builds images with the 'bud' subcommand, uses the 'push'
+// subcommand to write them to the standard output and the 'pull'
+// subcommand to load them from files.
+//
+type buildahEngine struct {
+	cliEngine
+}
+
+// NewBuildahEngine creates a container engine that uses the 'buildah'
+// command.
+//
+func NewBuildahEngine() ContainerEngine {
+	e := new(buildahEngine)
+	e.command = "buildah"
+	return e
+}
+
+func (e *buildahEngine) Build(options *BuildOptions) error {
+	args := []string{"bud"}
+	args = append(args, buildArgs(options)...)
+	if options.Pull {
+		args = append(args, "--pull-always")
+	}
+	args = append(args, options.Directory)
+	return runCommand(options.Stdout, options.Stderr, e.command, args...)
+}
+
+func (e *buildahEngine) Save(tag string, out io.Writer) error {
+	return runCommand(out, log.ErrorWriter(), e.command, "push", tag, fmt.Sprintf("docker-archive:/dev/stdout:%s", tag))
+}
+
+func (e *buildahEngine) ID(tag string) (string, error) {
+	return e.inspect(tag, "{{.FromImageID}}")
+}
+
+func (e *buildahEngine) Created(tag string) (time.Time, error) {
+	return e.created(tag, "{{.OCIv1.Created"+createdFormat+"}}")
+}
+
+func (e *buildahEngine) Load(path string) error {
+	// Archives that contain multiple images need to tell which one
+	// to pull, so pull each of them using its first tag:
+	var manifests []*dockerManifest
+	err := readTarEntry(path, "manifest.json", func(in io.Reader) error {
+		return json.NewDecoder(in).Decode(&manifests)
+	})
+	if err != nil {
+		return fmt.Errorf("Can't read manifest of archive '%s': %s", path, err)
+	}
+	if len(manifests) <= 1 {
+		return RunCommand(e.command, "pull", fmt.Sprintf("docker-archive:%s", path))
+	}
+	for i, manifest := range manifests {
+		if len(manifest.RepoTags) == 0 {
+			return fmt.Errorf("Image %d of archive '%s' doesn't have tags", i, path)
+		}
+		err = RunCommand(e.command, "pull", fmt.Sprintf("docker-archive:%s:%s", path, manifest.RepoTags[0]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *buildahEngine) Push(tag string) error {
+	return RunCommand(e.command, "push", tag, fmt.Sprintf("docker://%s", tag))
+}
+
+// sortedKeys returns the keys of the given map, sorted alphabetically.
+//
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,249 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+// This file contains the functions that are available to templates. The
+// complete list is the following:
+//
+//	tag NAME             The complete tag of the image with the given name.
+//	registry             The address of the image registry.
+//	prefix               The prefix of the names of the images.
+//	version              The version of the project.
+//	env NAME             The value of an environment variable.
+//	default DEF VALUE    VALUE if it isn't empty, otherwise DEF.
+//	required MSG VALUE   VALUE if it isn't empty, otherwise fails with MSG.
+//	include NAME [DATA]  The result of evaluating a named template.
+//	toYaml VALUE         The YAML representation of a value.
+//	toJson VALUE         The JSON representation of a value.
+//	indent N TEXT        The text with each line indented N spaces.
+//	nindent N TEXT       Like indent, but preceded by a new line.
+//	quote VALUE          The value as a double quoted string.
+//	b64enc TEXT          The base64 encoding of the text.
+//	sha256sum TEXT       The hex encoded SHA-256 digest of the text.
+//	readFile PATH        The content of a file inside the project.
+//
+// Functions that take the value to check or transform as their last
+// parameter can be used in pipelines. For example, the size of a volume
+// claim can be taken from an environment variable, with a default value:
+//
+//	storage: {{ env "OVIRT_ENGINE_CLAIM_SIZE" | default "10Gi" }}
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// templateFuncs returns the functions that are available to the given
+// template, evaluated with the given context.
+//
+func templateFuncs(ctx *Context, tmpl *template.Template) template.FuncMap {
+	return template.FuncMap{
+		"tag": func(name string) (string, error) {
+			return tagFunc(ctx, name)
+		},
+		"registry": func() string {
+			return ctx.project.Images().Registry()
+		},
+		"prefix": func() string {
+			return ctx.project.Images().Prefix()
+		},
+		"version": func() string {
+			return ctx.project.Version()
+		},
+		"env":      os.Getenv,
+		"default":  defaultFunc,
+		"required": requiredFunc,
+		"include": func(name string, data ...interface{}) (string, error) {
+			return includeFunc(ctx, tmpl, name, data...)
+		},
+		"toYaml":    toYamlFunc,
+		"toJson":    toJSONFunc,
+		"indent":    indentFunc,
+		"nindent":   nindentFunc,
+		"quote":     quoteFunc,
+		"b64enc":    b64encFunc,
+		"sha256sum": sha256sumFunc,
+		"readFile": func(path string) (string, error) {
+			return readFileFunc(ctx, path)
+		},
+	}
+}
+
+// isEmpty checks if the given value is nil or the zero value of its
+// type, or an empty slice or map.
+//
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return reflect.DeepEqual(value, reflect.Zero(v.Type()).Interface())
+}
+
+// defaultFunc returns the given value if it isn't empty, otherwise it
+// returns the default value.
+//
+func defaultFunc(def interface{}, value interface{}) interface{} {
+	if isEmpty(value) {
+		return def
+	}
+	return value
+}
+
+// requiredFunc returns the given value if it isn't empty, otherwise it
+// fails with the given message.
+//
+func requiredFunc(message string, value interface{}) (interface{}, error) {
+	if isEmpty(value) {
+		return nil, fmt.Errorf("%s", message)
+	}
+	return value, nil
+}
+
+// includeFunc evaluates the named template with the given data, or
+// with the context if no data is given, and returns the result as a
+// string, so that it can be used in pipelines.
+//
+func includeFunc(ctx *Context, tmpl *template.Template, name string, data ...interface{}) (string, error) {
+	var arg interface{} = ctx
+	switch len(data) {
+	case 0:
+	case 1:
+		arg = data[0]
+	default:
+		return "", fmt.Errorf("The include function accepts at most one data parameter")
+	}
+	buffer := new(bytes.Buffer)
+	err := tmpl.ExecuteTemplate(buffer, name, arg)
+	if err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// toYamlFunc returns the YAML representation of the given value,
+// without the trailing new line.
+//
+func toYamlFunc(value interface{}) (string, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// toJSONFunc returns the JSON representation of the given value.
+//
+func toJSONFunc(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// indentFunc adds the given number of spaces to the beginning of each
+// line of the given text.
+//
+func indentFunc(spaces int, text string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.Replace(text, "\n", "\n"+pad, -1)
+}
+
+// nindentFunc is like indentFunc, but it also adds a new line before
+// the text, so that it can be used in the same line than the YAML key
+// that it is the value of:
+//
+//	env:{{ .Values.env | toYaml | nindent 2 }}
+//
+func nindentFunc(spaces int, text string) string {
+	return "\n" + indentFunc(spaces, text)
+}
+
+// quoteFunc converts the given value to a string and returns it inside
+// double quotes, escaping special characters, so that it can be safely
+// used as a string in YAML or JSON documents.
+//
+func quoteFunc(value interface{}) string {
+	return strconv.Quote(fmt.Sprint(value))
+}
+
+// b64encFunc returns the base64 encoding of the given text, as used for
+// example in the data of OpenShift secrets.
+//
+func b64encFunc(text string) string {
+	return base64.StdEncoding.EncodeToString([]byte(text))
+}
+
+// sha256sumFunc returns the hex encoded SHA-256 digest of the given
+// text.
+//
+func sha256sumFunc(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// readFileFunc returns the content of a file. Relative paths are
+// relative to the root directory of the project. Files outside of that
+// directory can't be read, even if the path is absolute or uses
+// symbolic links, so that templates can't leak arbitrary files of the
+// machine where they are evaluated.
+//
+func readFileFunc(ctx *Context, path string) (string, error) {
+	root, err := filepath.EvalSymlinks(ctx.project.Directory())
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(ctx.project.Directory(), path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	relative, err := filepath.Rel(root, resolved)
+	if err != nil {
+		return "", err
+	}
+	if relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("File '%s' is outside of the project directory '%s'", path, root)
+	}
+	data, err := ioutil.ReadFile(resolved)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,230 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+// evalTemplate evaluates the given template text with the functions
+// available to templates, using the given directory as the root of the
+// project.
+//
+func evalTemplate(root, text string, values map[string]interface{}) (string, error) {
+	ctx := &Context{
+		project: &Project{
+			root: root,
+		},
+		Values: values,
+	}
+	tmpl := template.New("test")
+	tmpl.Funcs(templateFuncs(ctx, tmpl))
+	_, err := tmpl.Parse(text)
+	if err != nil {
+		return "", err
+	}
+	buffer := new(bytes.Buffer)
+	err = tmpl.Execute(buffer, ctx)
+	return buffer.String(), err
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	// Prepare a project directory with a file inside, and a file
+	// outside of it, that templates shouldn't be able to read:
+	tmp, err := ioutil.TempDir("", "functions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "project")
+	err = os.MkdirAll(filepath.Join(root, "files"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "files", "motd"), []byte("Welcome"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(tmp, "secret")
+	err = ioutil.WriteFile(secret, []byte("Secret"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(secret, filepath.Join(root, "files", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]interface{}{
+		"name":  "engine",
+		"empty": "",
+		"env": map[string]interface{}{
+			"A": "1",
+			"B": "2",
+		},
+		"ports": []interface{}{8080, 8443},
+	}
+
+	tests := []struct {
+		name     string
+		text     string
+		expected string
+		err      string
+	}{
+		{
+			name:     "Default with empty value",
+			text:     `{{ .Values.empty | default "10Gi" }}`,
+			expected: "10Gi",
+		},
+		{
+			name:     "Default with value",
+			text:     `{{ .Values.name | default "other" }}`,
+			expected: "engine",
+		},
+		{
+			name:     "Default with zero number",
+			text:     `{{ 0 | default 5 }}`,
+			expected: "5",
+		},
+		{
+			name:     "Required with value",
+			text:     `{{ .Values.name | required "Name is required" }}`,
+			expected: "engine",
+		},
+		{
+			name: "Required without value",
+			text: `{{ .Values.empty | required "Name is required" }}`,
+			err:  "Name is required",
+		},
+		{
+			name:     "Indent",
+			text:     `{{ "a\nb" | indent 2 }}`,
+			expected: "  a\n  b",
+		},
+		{
+			name:     "Nindent",
+			text:     `env:{{ .Values.env | toYaml | nindent 2 }}`,
+			expected: "env:\n  A: \"1\"\n  B: \"2\"",
+		},
+		{
+			name:     "Quote",
+			text:     `{{ "say \"hi\"\n" | quote }}`,
+			expected: `"say \"hi\"\n"`,
+		},
+		{
+			name:     "Quote number",
+			text:     `{{ 42 | quote }}`,
+			expected: `"42"`,
+		},
+		{
+			name:     "ToYaml",
+			text:     `{{ .Values.ports | toYaml }}`,
+			expected: "- 8080\n- 8443",
+		},
+		{
+			name:     "ToJson",
+			text:     `{{ .Values.env | toJson }}`,
+			expected: `{"A":"1","B":"2"}`,
+		},
+		{
+			name:     "B64enc",
+			text:     `{{ "redhat123" | b64enc }}`,
+			expected: "cmVkaGF0MTIz",
+		},
+		{
+			name:     "Sha256sum",
+			text:     `{{ "hello" | sha256sum }}`,
+			expected: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		},
+		{
+			name:     "Include with context",
+			text:     `{{ define "name" }}{{ .Values.name }}{{ end }}{{ include "name" | quote }}`,
+			expected: `"engine"`,
+		},
+		{
+			name:     "Include with data",
+			text:     `{{ define "greet" }}Hello {{ . }}{{ end }}{{ include "greet" "world" }}`,
+			expected: "Hello world",
+		},
+		{
+			name: "Include with too many parameters",
+			text: `{{ define "greet" }}{{ end }}{{ include "greet" "a" "b" }}`,
+			err:  "accepts at most one data parameter",
+		},
+		{
+			name: "Include missing template",
+			text: `{{ include "missing" }}`,
+			err:  "missing",
+		},
+		{
+			name:     "ReadFile relative",
+			text:     `{{ readFile "files/motd" }}`,
+			expected: "Welcome",
+		},
+		{
+			name:     "ReadFile absolute inside project",
+			text:     `{{ readFile "` + filepath.Join(root, "files", "motd") + `" }}`,
+			expected: "Welcome",
+		},
+		{
+			name: "ReadFile escaping with dots",
+			text: `{{ readFile "../secret" }}`,
+			err:  "outside of the project directory",
+		},
+		{
+			name: "ReadFile escaping with absolute path",
+			text: `{{ readFile "` + secret + `" }}`,
+			err:  "outside of the project directory",
+		},
+		{
+			name: "ReadFile escaping with symbolic link",
+			text: `{{ readFile "files/link" }}`,
+			err:  "outside of the project directory",
+		},
+		{
+			name: "ReadFile missing",
+			text: `{{ readFile "files/missing" }}`,
+			err:  "no such file",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := evalTemplate(root, test.text, values)
+			if test.err != "" {
+				if err == nil {
+					t.Fatalf("Expected an error containing '%s', got result '%s'", test.err, result)
+				}
+				if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected an error containing '%s', got '%s'", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected '%s', got '%s'", test.expected, result)
+			}
+		})
+	}
+}
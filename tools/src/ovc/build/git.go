@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+// This file contains functions used to extract information from the git
+// repository that contains the project.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The value of the version parameter that indicates that the version
+// should be calculated from the git metadata.
+//
+const autoVersion = "auto"
+
+// The version used when the project has been extracted from the binary
+// and the version wasn't set when the binary was built, as then there is
+// no git repository to calculate it from.
+//
+const devVersion = "dev"
+
+// gitVersion calculates the version of the project from the tags of the
+// git repository that contains the given directory, using the 'git
+// describe' command. If there are uncommitted changes the version will
+// have the '-dirty' suffix. If there are no tags the version will be the
+// abbreviated identifier of the current commit.
+//
+func gitVersion(dir string) (version string, err error) {
+	out := EvalCommand("git", "-C", dir, "describe", "--tags", "--dirty", "--always")
+	if out == nil {
+		err = fmt.Errorf("Can't calculate the version from the git repository of directory '%s'", dir)
+		return
+	}
+	version = strings.TrimSpace(string(out))
+	return
+}
+
+// The maximum length of the tag part of image references.
+//
+const maxTagLength = 128
+
+// normalizeVersion replaces the characters of the given version that
+// aren't valid in image tags, like the slashes of tags named
+// 'release/4.2', with dashes. Tags also can't start with a dot or a
+// dash, so those are removed.
+//
+func normalizeVersion(version string) string {
+	version = strings.Map(func(char rune) rune {
+		switch {
+		case char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z':
+			return char
+		case char >= '0' && char <= '9', char == '_', char == '.', char == '-':
+			return char
+		}
+		return '-'
+	}, version)
+	version = strings.TrimLeft(version, ".-")
+	if len(version) > maxTagLength {
+		version = version[0:maxTagLength]
+	}
+	return version
+}
+
+// gitSHA returns the abbreviated identifier of the current commit of the
+// git repository that contains the given directory.
+//
+func gitSHA(dir string) (sha string, err error) {
+	out := EvalCommand("git", "-C", dir, "rev-parse", "--short", "HEAD")
+	if out == nil {
+		err = fmt.Errorf("Can't get the current commit from the git repository of directory '%s'", dir)
+		return
+	}
+	sha = strings.TrimSpace(string(out))
+	return
+}
@@ -0,0 +1,44 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeVersion(t *testing.T) {
+	tests := []struct {
+		version  string
+		expected string
+	}{
+		{"4.2.0", "4.2.0"},
+		{"v4.2.0-3-g1a2b3c4-dirty", "v4.2.0-3-g1a2b3c4-dirty"},
+		{"release/4.2", "release-4.2"},
+		{"4.2+build.1", "4.2-build.1"},
+		{"-4.2", "4.2"},
+		{".hidden", "hidden"},
+		{"versión", "versi-n"},
+		{strings.Repeat("a", 200), strings.Repeat("a", 128)},
+	}
+	for _, test := range tests {
+		actual := normalizeVersion(test.version)
+		if actual != test.expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", test.expected, test.version, actual)
+		}
+	}
+}
@@ -20,23 +20,92 @@ package build
 // descriptions of images.
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"text/template"
+
+	"ovc/log"
 )
 
 // Image contains the description of an image, as well as methods to
 // build it.
 //
 type Image struct {
-	project    *Project
-	name       string
-	tag        string
-	dockerfile *Dockerfile
-	parent     *Image
+	project      *Project
+	name         string
+	tag          string
+	tags         []string
+	loaded       bool
+	dockerfile   *Dockerfile
+	dependencies []*Image
+	externals    []string
+	options      *ImageOptions
+
+	// The digest of the contents of the image, calculated only when
+	// needed:
+	digest     string
+	digestErr  error
+	digestOnce sync.Once
+}
+
+// ImageOptions contains the options used to build an image, as given
+// in the project configuration.
+//
+type ImageOptions struct {
+	// The values of the build arguments, used by the ARG
+	// instructions of the Dockerfile.
+	Args map[string]string
+
+	// The labels that will be added to the image.
+	Labels map[string]string
+
+	// The name of the stage of the Dockerfile that will be built. If
+	// empty the last stage will be built.
+	Target string
+
+	// Indicates if the build should ignore the cache.
+	NoCache bool
+
+	// Indicates if the build should always pull the base images.
+	Pull bool
+
+	// Indicates if the image is enabled. Disabled images aren't
+	// built, saved, pushed or removed, but their tags can still be
+	// used, assuming that they are available in the registry.
+	Enabled bool
+
+	// The name, prefix and registry used in the tags of the image.
+	// When empty the name of the directory of the image and the
+	// prefix and registry of the project are used.
+	Name     string
+	Prefix   string
+	Registry string
 }
 
+// NewImageOptions creates a new set of options, with empty arguments
+// and labels, for an enabled image.
+//
+func NewImageOptions() *ImageOptions {
+	o := new(ImageOptions)
+	o.Enabled = true
+	o.Args = make(map[string]string)
+	o.Labels = make(map[string]string)
+	return o
+}
+
+// The name of the label used to store the digest of the contents of
+// the image.
+//
+const digestLabel = "org.ovirt.ovc.digest"
+
 // NewImage creates a new empty image with the given name and belonging
 // to the given project.
 //
@@ -44,6 +113,7 @@ func NewImage(project *Project, name string) *Image {
 	i := new(Image)
 	i.project = project
 	i.name = name
+	i.options = NewImageOptions()
 	return i
 }
 
@@ -51,26 +121,19 @@ func NewImage(project *Project, name string) *Image {
 // the Dockerfile, if it exists.
 //
 func (i *Image) Load() error {
-	// If the tag already has a value then the image has been loaded
-	// before, so we don't need to do anything:
-	if i.tag != "" {
+	// If the image has been loaded before we don't need to do
+	// anything:
+	if i.loaded {
 		return nil
 	}
+	i.loaded = true
 
-	// Calculate the tag:
-	i.tag = fmt.Sprintf(
-		"%s/%s:%s",
-		i.project.Images().Prefix(),
-		i.name,
-		i.project.Version(),
-	)
-	registry := i.project.Images().Registry()
-	if registry != "" {
-		i.tag = fmt.Sprintf(
-			"%s/%s",
-			registry,
-			i.tag,
-		)
+	// Calculate the tags, if they haven't been calculated yet:
+	if i.tag == "" {
+		err := i.calculateTags()
+		if err != nil {
+			return err
+		}
 	}
 
 	// Process the templates:
@@ -83,13 +146,112 @@ func (i *Image) Load() error {
 
 	// Check if there is a Dockerfile in the working directory, and
 	// if it does then load it:
-        dockerfilePath := filepath.Join(work, "Dockerfile")
-        if _, err := os.Stat(dockerfilePath); err == nil {
-                i.dockerfile = NewDockerfile()
-                i.dockerfile.Load(dockerfilePath)
-        }
+	dockerfilePath := filepath.Join(work, "Dockerfile")
+	if _, err := os.Stat(dockerfilePath); err == nil {
+		i.dockerfile = NewDockerfile()
+		err = i.dockerfile.Load(dockerfilePath)
+		if err != nil {
+			return err
+		}
+
+		// The build arguments given in the configuration replace
+		// the default values of the arguments declared in the
+		// Dockerfile, as those may be used in the FROM
+		// instructions:
+		for name, value := range i.options.Args {
+			if _, declared := i.dockerfile.Args()[name]; declared {
+				i.dockerfile.SetArg(name, value)
+			}
+		}
+	}
+
+	return nil
+}
+
+// calculateTags calculates the tags of the image from the registry, the
+// prefix and the name returned by tagParts and the results of evaluating
+// the tag formats. The first tag is the primary tag.
+//
+func (i *Image) calculateTags() error {
+	i.tags = []string{}
+	registry, prefix, name := i.tagParts()
+	ctx := &tagContext{
+		image: i,
+	}
+	for _, format := range i.project.Images().tagFormats {
+		buffer := new(bytes.Buffer)
+		err := format.Execute(buffer, ctx)
+		if err != nil {
+			return fmt.Errorf("Can't calculate tag of image '%s': %s", i.name, err)
+		}
+		suffix := strings.TrimSpace(buffer.String())
+		if suffix == "" {
+			return fmt.Errorf("Tag format '%s' produces an empty tag for image '%s'", format.Name(), i.name)
+		}
+		tag := fmt.Sprintf("%s/%s:%s", prefix, name, suffix)
+		if registry != "" {
+			tag = fmt.Sprintf("%s/%s", registry, tag)
+		}
+		i.tags = append(i.tags, tag)
+	}
+	i.tag = i.tags[0]
+	return nil
+}
+
+// tagParts returns the registry, the prefix and the name used in the
+// tags of the image, taking into account the overrides given in the
+// options of the image.
+//
+func (i *Image) tagParts() (registry, prefix, name string) {
+	registry = i.project.Images().Registry()
+	if i.options.Registry != "" {
+		registry = i.options.Registry
+	}
+	prefix = i.project.Images().Prefix()
+	if i.options.Prefix != "" {
+		prefix = i.options.Prefix
+	}
+	name = i.name
+	if i.options.Name != "" {
+		name = i.options.Name
+	}
+	return
+}
+
+// tagContext contains the data that is available to the formats used
+// to calculate the tags of the images.
+//
+type tagContext struct {
+	image *Image
+}
+
+// Name returns the name of the image, as used in the tags.
+//
+func (c *tagContext) Name() string {
+	_, _, name := c.image.tagParts()
+	return name
+}
+
+// Version returns the version of the project.
+//
+func (c *tagContext) Version() string {
+	return c.image.project.Version()
+}
+
+// GitSHA returns the abbreviated identifier of the current commit of the
+// git repository that contains the project. When the project has been
+// extracted from the binary it is the commit that the binary was built
+// from.
+//
+func (c *tagContext) GitSHA() (string, error) {
+	return c.image.project.gitSHA()
+}
 
-        return nil
+// Date returns the date when the project was loaded, in 'YYYYMMDD'
+// format.
+//
+func (c *tagContext) Date() string {
+	return c.image.project.date.Format("20060102")
 }
 
 // Directory returns the absolute path of the directory that contains the
@@ -112,12 +274,18 @@ func (i *Image) Name() string {
 	return i.name
 }
 
-// Tag returns the tag of the image.
+// Tag returns the primary tag of the image.
 //
 func (i *Image) Tag() string {
 	return i.tag
 }
 
+// Tags returns all the tags of the image, starting with the primary tag.
+//
+func (i *Image) Tags() []string {
+	return i.tags
+}
+
 // Dockerfile returns the object that describes the Dockerfile used by
 // the image.
 //
@@ -125,10 +293,47 @@ func (i *Image) Dockerfile() *Dockerfile {
 	return i.dockerfile
 }
 
-// Parent returns the parent image.
+// Options returns the options used to build the image.
+//
+func (i *Image) Options() *ImageOptions {
+	return i.options
+}
+
+// Dependencies returns the images of the project that this image
+// depends on, either because they are the base of one of the stages of
+// the Dockerfile, or because files are copied from them.
+//
+func (i *Image) Dependencies() []*Image {
+	return i.dependencies
+}
+
+// ExternalDependencies returns the references to the images that this
+// image depends on, but that aren't part of the project, for example
+// 'centos:7'.
+//
+func (i *Image) ExternalDependencies() []string {
+	return i.externals
+}
+
+// Ancestors returns the dependencies of the image, the dependencies of
+// the dependencies, and so on, starting with the nearest ones. Each
+// image appears only once.
 //
-func (i *Image) Parent() *Image {
-	return i.parent
+func (i *Image) Ancestors() []*Image {
+	ancestors := []*Image{}
+	visited := make(map[*Image]bool)
+	pending := append([]*Image{}, i.dependencies...)
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		ancestors = append(ancestors, current)
+		pending = append(pending, current.dependencies...)
+	}
+	return ancestors
 }
 
 // String returns a string representation of the image.
@@ -137,65 +342,416 @@ func (i *Image) String() string {
 	return i.Tag()
 }
 
-// Build builds the given image.
+// Digest calculates a digest of the contents of the working directory
+// of the image, after processing the templates, combined with the
+// digests of the images that it depends on. Any change in the image or
+// in any of its ancestors results in a different digest.
 //
-func (i *Image) Build() error {
-	return RunCommand(
-		"docker",
-		"build",
-		fmt.Sprintf("--tag=%s", i.Tag()),
-		i.WorkingDirectory(),
-	)
+func (i *Image) Digest() (string, error) {
+	i.digestOnce.Do(func() {
+		i.digest, i.digestErr = i.calculateDigest()
+	})
+	return i.digest, i.digestErr
+}
+
+func (i *Image) calculateDigest() (digest string, err error) {
+	hash := sha256.New()
+
+	// Add the digests of the dependencies, which are sorted by name
+	// when they are resolved:
+	for _, dependency := range i.dependencies {
+		var value string
+		value, err = dependency.Digest()
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(hash, "dependency %s %s\n", dependency.name, value)
+	}
+
+	// Add the build options that change the content of the image:
+	for _, name := range sortedKeys(i.options.Args) {
+		fmt.Fprintf(hash, "arg %s=%s\n", name, i.options.Args[name])
+	}
+	for _, name := range sortedKeys(i.options.Labels) {
+		fmt.Fprintf(hash, "label %s=%s\n", name, i.options.Labels[name])
+	}
+	fmt.Fprintf(hash, "target %s\n", i.options.Target)
+
+	// Add the names, permissions and contents of the files of the
+	// working directory. Note that the walk function visits the
+	// files in lexical order, so the result doesn't depend on the
+	// order of the files in the file system.
+	work := i.WorkingDirectory()
+	err = filepath.Walk(work, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(work, path)
+		if err != nil {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+		switch {
+		case info.Mode().IsDir():
+			fmt.Fprintf(hash, "dir %s %o\n", relative, info.Mode().Perm())
+		case info.Mode().IsRegular():
+			fmt.Fprintf(hash, "file %s %o %d\n", relative, info.Mode().Perm(), info.Size())
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = io.Copy(hash, file)
+			if err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "link %s %s\n", relative, target)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	digest = fmt.Sprintf("sha256:%x", hash.Sum(nil))
+	return
 }
 
-// Saves the image to a tar file.
+// UpToDate checks if the local image storage already contains an image
+// built from the current contents of the image. If it does, it makes
+// sure that the tags of the image point to it.
 //
-func (i *Image) Save() error {
-	// Get the tag of the image and calculate a file name from it,
-	// replacing all characters that aren't convenient in file names
-	// (slashes and colons) with dashes:
-	tag := i.Tag()
-	replacer := strings.NewReplacer(
-		"/", "-",
-		":", "-",
-	)
-	path := replacer.Replace(tag) + ".tar"
-
-	// Save the image to a tar file:
-	err := RunCommand(
-		"docker",
-		"save",
-		tag,
-		fmt.Sprintf("--output=%s", path),
-	)
+func (i *Image) UpToDate() (bool, error) {
+	digest, err := i.Digest()
+	if err != nil {
+		return false, err
+	}
+	engine := i.project.Images().Engine()
+	ids, err := engine.Find(digestLabel, digest)
+	if err != nil {
+		return false, err
+	}
+	if len(ids) == 0 {
+		return false, nil
+	}
+	for _, tag := range i.tags {
+		err = engine.Tag(ids[0], tag)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Build builds the given image. The output of the build is written to
+// the log with the name of the image as prefix of each line, so that
+// it is possible to build multiple images concurrently.
+//
+// The build arguments and other options given in the configuration of
+// the project are passed to the container engine. The digest of the
+// contents of the image is stored in a label of the built image. If an
+// image with the same digest already exists, and the force parameter
+// is false, the build is skipped.
+//
+func (i *Image) Build(force bool) error {
+	digest, err := i.Digest()
+	if err != nil {
+		return err
+	}
+	if !force {
+		current, err := i.UpToDate()
+		if err != nil {
+			return err
+		}
+		if current {
+			log.Info("Image '%s' is up to date, skipping build", i)
+			return nil
+		}
+	}
+	prefix := fmt.Sprintf("[%s] ", i.name)
+	stdout := log.NewLineWriter(log.DebugWriter(), prefix)
+	defer stdout.Close()
+	stderr := log.NewLineWriter(log.ErrorWriter(), prefix)
+	defer stderr.Close()
+	labels := make(map[string]string)
+	for name, value := range i.options.Labels {
+		labels[name] = value
+	}
+	labels[digestLabel] = digest
+	engine := i.project.Images().Engine()
+	err = engine.Build(&BuildOptions{
+		Directory: i.WorkingDirectory(),
+		Tag:       i.Tag(),
+		Args:      i.options.Args,
+		Labels:    labels,
+		Target:    i.options.Target,
+		NoCache:   i.options.NoCache,
+		Pull:      i.options.Pull,
+		Stdout:    stdout,
+		Stderr:    stderr,
+	})
 	if err != nil {
 		return err
 	}
 
-	// Compress the tar file, using gzip:
-	return RunCommand(
-		"gzip",
-		"--force",
-		path,
+	// Add the rest of the tags:
+	for _, tag := range i.tags[1:] {
+		err = engine.Tag(i.tag, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveOptions contains the parameters used to save images to files.
+//
+type SaveOptions struct {
+	// The directory where the files will be written. If empty the
+	// current working directory will be used.
+	Directory string
+
+	// The template used to calculate the names of the files. It can
+	// use the name of the image as '{{.Name}}', the primary tag as
+	// '{{.Tag}}', with slashes and colons replaced by dashes, the
+	// version of the project as '{{.Version}}' and the extension of
+	// the file, including the format and the compression, as
+	// '{{.Ext}}'. If empty DefaultSavePattern will be used.
+	Pattern string
+
+	// The compression algorithm, one of 'gzip', 'pgzip', 'zstd' or
+	// 'none'. If empty 'gzip' will be used. It is ignored when the
+	// format is 'oci-dir'.
+	Compression string
+
+	// The format of the files, one of 'docker-archive', 'oci' or
+	// 'oci-dir'. If empty 'docker-archive' will be used.
+	Format string
+}
+
+// DefaultSavePattern is the template used to calculate the names of the
+// files where images are saved when no other pattern is given.
+//
+const DefaultSavePattern = "{{.Tag}}{{.Ext}}"
+
+// saveContext contains the data available to the template used to
+// calculate the names of the files where images are saved.
+//
+type saveContext struct {
+	Name    string
+	Tag     string
+	Version string
+	Ext     string
+}
+
+// Save writes the image to a tar file, compressing it while it is
+// written, or to a directory, and returns the path of the file or
+// directory. It also writes a metadata file that describes the image,
+// with the path returned by MetadataPath.
+//
+func (i *Image) Save(options *SaveOptions) (path string, err error) {
+	path, err = i.SavePath(options)
+	if err != nil {
+		return
+	}
+	options = options.withDefaults()
+
+	// The file name pattern may contain directories, so make sure
+	// that they exist:
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		err = fmt.Errorf("Can't create directory '%s' for image '%s': %s", dir, i.name, err)
+		return
+	}
+
+	log.Debug("Saving image '%s' to file '%s'", i.name, path)
+	err = i.writeFile(path, options.Format, options.Compression)
+	if err != nil {
+		return
+	}
+
+	// Write the metadata file next to the image:
+	err = i.writeMetadata(path, options.Format, options.Compression)
+	return
+}
+
+// SavePath calculates the path of the file or directory where the image
+// would be written by the Save method with the given options, without
+// writing anything.
+//
+func (i *Image) SavePath(options *SaveOptions) (path string, err error) {
+	options = options.withDefaults()
+	ctx := &saveContext{
+		Name:    i.name,
+		Tag:     fileNameTag(i.tag),
+		Version: i.project.Version(),
+		Ext:     FormatExtension(options.Format, options.Compression),
+	}
+	tmpl, err := template.New("file").Option("missingkey=error").Parse(options.Pattern)
+	if err != nil {
+		err = fmt.Errorf("Can't parse file name pattern '%s': %s", options.Pattern, err)
+		return
+	}
+	buffer := new(bytes.Buffer)
+	err = tmpl.Execute(buffer, ctx)
+	if err != nil {
+		err = fmt.Errorf("Can't evaluate file name pattern '%s': %s", options.Pattern, err)
+		return
+	}
+	// The pattern may contain directories, but the result must be
+	// inside the output directory:
+	name := filepath.Clean(buffer.String())
+	if filepath.IsAbs(name) || name == "." || name == ".." ||
+		strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		err = fmt.Errorf(
+			"File name pattern '%s' gives path '%s', which isn't inside the output directory",
+			options.Pattern, name,
+		)
+		return
+	}
+	path = filepath.Join(options.Directory, name)
+	return
+}
+
+// withDefaults returns a copy of the options where the options that
+// haven't been given are replaced by their default values.
+//
+func (o *SaveOptions) withDefaults() *SaveOptions {
+	result := *o
+	if result.Pattern == "" {
+		result.Pattern = DefaultSavePattern
+	}
+	if result.Compression == "" {
+		result.Compression = CompressionGzip
+	}
+	if result.Format == "" {
+		result.Format = FormatDockerArchive
+	}
+	return &result
+}
+
+// writeFile writes the image to the given file, or directory, using
+// the given format and compression algorithm.
+//
+func (i *Image) writeFile(path, format, compression string) error {
+	switch format {
+	case FormatDockerArchive:
+		return i.writeArchive(path, compression)
+	case FormatOCI, FormatOCIDir:
+		return i.writeOCI(path, format, compression)
+	default:
+		return CheckFormat(format)
+	}
+}
+
+// writeArchive writes the image, in docker-archive format, to the given
+// file, compressing it with the given algorithm.
+//
+func (i *Image) writeArchive(path, compression string) error {
+	return writeCompressedFile(path, compression, func(out io.Writer) error {
+		return i.project.Images().Engine().Save(i.tag, out)
+	})
+}
+
+// writeOCI writes the image, in OCI image-layout format, to the given
+// file or directory. The container engines generate docker-archive
+// files, so the image is first written in that format to a temporary
+// directory, next to the result, and then converted.
+//
+func (i *Image) writeOCI(path, format, compression string) error {
+	tmpDir, err := ioutil.TempDir(filepath.Dir(path), ".oci")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Write the image in docker-archive format, and convert it:
+	archive := filepath.Join(tmpDir, "image.tar")
+	err = i.writeArchive(archive, CompressionNone)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(tmpDir, "layout")
+	layout, err := newOCILayout(dir, i.project.Version())
+	if err != nil {
+		return err
+	}
+	err = layout.addArchive(archive, i.tags)
+	if err != nil {
+		return err
+	}
+	os.Remove(archive)
+	err = layout.close()
+	if err != nil {
+		return err
+	}
+
+	// Move the directory to its final location, or write it to a tar
+	// file:
+	if format == FormatOCIDir {
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+		return os.Rename(dir, path)
+	}
+	return writeCompressedFile(path, compression, func(out io.Writer) error {
+		writer := tar.NewWriter(out)
+		err := addTarDirectory(writer, "", dir)
+		if err != nil {
+			return err
+		}
+		return writer.Close()
+	})
+}
+
+// ID returns the identifier of the image in the local image storage.
+//
+func (i *Image) ID() (string, error) {
+	return i.project.Images().Engine().ID(i.tag)
+}
+
+// fileNameTag replaces the characters of the given tag that aren't
+// convenient in file names, slashes and colons, with dashes.
+//
+func fileNameTag(tag string) string {
+	replacer := strings.NewReplacer(
+		"/", "-",
+		":", "-",
 	)
+	return replacer.Replace(tag)
 }
 
-// Push pushes the image to the docker registry.
+// Push pushes the image to the registry, with all its tags.
 //
 func (i *Image) Push() error {
-	return RunCommand(
-		"docker",
-		"push",
-		i.Tag(),
-	)
+	for _, tag := range i.tags {
+		err := i.project.Images().Engine().Push(tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Remove removes the image from the local docker storage.
+// Remove removes all the tags of the image from the local image
+// storage. Failures to remove the tags other than the primary tag are
+// reported as warnings, as those tags may depend on the date or on the
+// commit, and then they may not exist.
 //
 func (i *Image) Remove() error {
-	return RunCommand(
-		"docker",
-		"rmi",
-		i.Tag(),
-	)
+	engine := i.project.Images().Engine()
+	for _, tag := range i.tags[1:] {
+		err := engine.Remove(tag)
+		if err != nil {
+			log.Warning("Can't remove tag '%s' of image '%s': %s", tag, i.name, err)
+		}
+	}
+	return engine.Remove(i.tag)
 }
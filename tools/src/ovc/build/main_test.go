@@ -0,0 +1,50 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ovc/log"
+)
+
+// TestMain opens the log, in a temporary directory, before running the
+// tests, as most of the functions of the package write to it.
+//
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	tmp, err := ioutil.TempDir("", "build")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't create temporary directory for the log: %s\n", err)
+		return 1
+	}
+	defer os.RemoveAll(tmp)
+	err = log.Open(filepath.Join(tmp, "test.log"), false, ioutil.Discard)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't open log: %s\n", err)
+		return 1
+	}
+	defer log.Close()
+	return m.Run()
+}
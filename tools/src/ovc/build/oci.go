@@ -0,0 +1,409 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+// This file contains the formats used to save images, and the functions
+// that convert the docker-archive files generated by the container
+// engines into the OCI image-layout format.
+//
+// The layouts generated also contain a 'manifest.json' file in the
+// format used by 'docker save', pointing to the same blobs, so that they
+// can be loaded with 'docker load' as well as with the tools that
+// understand the OCI format.
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Names of the supported formats for saved images.
+//
+const (
+	// A tar file in the format generated by 'docker save'.
+	FormatDockerArchive = "docker-archive"
+
+	// A tar file that contains an OCI image layout.
+	FormatOCI = "oci"
+
+	// A directory that contains an OCI image layout.
+	FormatOCIDir = "oci-dir"
+)
+
+// Names of the supported formats, in the order used in messages.
+//
+var formatNames = []string{
+	FormatDockerArchive,
+	FormatOCI,
+	FormatOCIDir,
+}
+
+// CheckFormat checks that the given format is supported.
+//
+func CheckFormat(name string) error {
+	for _, supported := range formatNames {
+		if name == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf(
+		"Unknown format '%s', should be one of '%s'",
+		name,
+		strings.Join(formatNames, "', '"),
+	)
+}
+
+// FormatExtension returns the extension that is added to the name of
+// files saved with the given format and compression algorithm.
+//
+func FormatExtension(format, compression string) string {
+	switch format {
+	case FormatOCI:
+		return ".oci.tar" + CompressionExtension(compression)
+	case FormatOCIDir:
+		return ".oci"
+	default:
+		return ".tar" + CompressionExtension(compression)
+	}
+}
+
+// Media types and annotations of the OCI image specification.
+//
+const (
+	ociIndexMediaType      = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType   = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType     = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType      = "application/vnd.oci.image.layer.v1.tar"
+	ociGzipLayerMediaType  = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociRefNameAnnotation   = "org.opencontainers.image.ref.name"
+	ociVersionAnnotation   = "org.opencontainers.image.version"
+	ociImageNameAnnotation = "io.containerd.image.name"
+)
+
+// ociDescriptor is a reference to a blob of an OCI image layout.
+//
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociIndex is the content of the 'index.json' file of an OCI image
+// layout.
+//
+type ociIndex struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	MediaType     string           `json:"mediaType"`
+	Manifests     []*ociDescriptor `json:"manifests"`
+}
+
+// ociManifest is the manifest of an image inside an OCI image layout.
+//
+type ociManifest struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	MediaType     string           `json:"mediaType"`
+	Config        *ociDescriptor   `json:"config"`
+	Layers        []*ociDescriptor `json:"layers"`
+}
+
+// dockerManifest is one of the entries of the 'manifest.json' file of
+// the archives generated by 'docker save'.
+//
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// ociLayout writes images to a directory using the OCI image-layout
+// format.
+//
+type ociLayout struct {
+	dir     string
+	version string
+	index   *ociIndex
+	docker  []*dockerManifest
+}
+
+// newOCILayout creates an empty OCI image layout in the given
+// directory. The given version of the project is added as an annotation
+// to the images.
+//
+func newOCILayout(dir, version string) (layout *ociLayout, err error) {
+	err = os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755)
+	if err != nil {
+		return
+	}
+	layout = &ociLayout{
+		dir:     dir,
+		version: version,
+		index: &ociIndex{
+			SchemaVersion: 2,
+			MediaType:     ociIndexMediaType,
+			Manifests:     []*ociDescriptor{},
+		},
+		docker: []*dockerManifest{},
+	}
+	return
+}
+
+// addArchive copies to the layout the image contained in the given
+// docker-archive file, and adds it to the index once for each of the
+// given tags.
+//
+func (l *ociLayout) addArchive(archive string, tags []string) error {
+	// Read the manifest of the archive, which tells which entries
+	// contain the configuration and the layers:
+	var manifests []*dockerManifest
+	err := readTarEntry(archive, "manifest.json", func(in io.Reader) error {
+		return json.NewDecoder(in).Decode(&manifests)
+	})
+	if err != nil {
+		return fmt.Errorf("Can't read manifest of archive '%s': %s", archive, err)
+	}
+	if len(manifests) != 1 {
+		return fmt.Errorf(
+			"Archive '%s' should contain exactly one image, but it contains %d",
+			archive,
+			len(manifests),
+		)
+	}
+	manifest := manifests[0]
+
+	// Copy the configuration and the layers to the blobs directory.
+	// Archives generated by some versions of docker contain symbolic
+	// links to avoid repeating layers, so remember them and resolve
+	// them when all the entries have been copied:
+	wanted := make(map[string]bool)
+	wanted[manifest.Config] = true
+	for _, layer := range manifest.Layers {
+		wanted[layer] = true
+	}
+	blobs := make(map[string]*ociDescriptor)
+	links := make(map[string]string)
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !wanted[header.Name] {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			links[header.Name] = path.Join(path.Dir(header.Name), header.Linkname)
+		case tar.TypeLink:
+			links[header.Name] = header.Linkname
+		default:
+			blobs[header.Name], err = l.addBlob(reader)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for name, target := range links {
+		if blobs[target] == nil {
+			return fmt.Errorf("Entry '%s' of archive '%s' points to missing '%s'", name, archive, target)
+		}
+		blobs[name] = blobs[target]
+	}
+
+	// Create the OCI manifest:
+	config := blobs[manifest.Config]
+	if config == nil {
+		return fmt.Errorf("Archive '%s' doesn't contain configuration '%s'", archive, manifest.Config)
+	}
+	result := &ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config: &ociDescriptor{
+			MediaType: ociConfigMediaType,
+			Digest:    config.Digest,
+			Size:      config.Size,
+		},
+		Layers: make([]*ociDescriptor, len(manifest.Layers)),
+	}
+	docker := &dockerManifest{
+		Config:   blobPath(config.Digest),
+		RepoTags: tags,
+		Layers:   make([]string, len(manifest.Layers)),
+	}
+	for i, layer := range manifest.Layers {
+		blob := blobs[layer]
+		if blob == nil {
+			return fmt.Errorf("Archive '%s' doesn't contain layer '%s'", archive, layer)
+		}
+		result.Layers[i] = blob
+		docker.Layers[i] = blobPath(blob.Digest)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	descriptor, err := l.addBlob(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	// Add the manifest to the index once for each tag, so that the
+	// image can be referenced by any of them:
+	for _, tag := range tags {
+		l.index.Manifests = append(l.index.Manifests, &ociDescriptor{
+			MediaType: ociManifestMediaType,
+			Digest:    descriptor.Digest,
+			Size:      descriptor.Size,
+			Annotations: map[string]string{
+				ociRefNameAnnotation:   tag,
+				ociImageNameAnnotation: tag,
+				ociVersionAnnotation:   l.version,
+			},
+		})
+	}
+	l.docker = append(l.docker, docker)
+	return nil
+}
+
+// addBlob copies the content of the given reader to the blobs directory
+// of the layout, and returns its descriptor. The media type of the
+// descriptor is the type of a layer, compressed or not, and needs to be
+// changed for other kinds of blobs.
+//
+func (l *ociLayout) addBlob(in io.Reader) (descriptor *ociDescriptor, err error) {
+	// Detect if the content is compressed:
+	buffered := bufio.NewReader(in)
+	magic, err := buffered.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return
+	}
+	mediaType := ociLayerMediaType
+	if bytes.Equal(magic, gzipMagic) {
+		mediaType = ociGzipLayerMediaType
+	}
+
+	// Copy the content to a temporary file, calculating the digest,
+	// and then rename it to the digest:
+	tmp, err := ioutil.TempFile(filepath.Join(l.dir, "blobs"), "blob")
+	if err != nil {
+		return
+	}
+	defer func() {
+		tmp.Close()
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), buffered)
+	if err != nil {
+		return
+	}
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return
+	}
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	err = os.Rename(tmp.Name(), filepath.Join(l.dir, filepath.FromSlash(blobPath(digest))))
+	if err != nil {
+		return
+	}
+	descriptor = &ociDescriptor{
+		MediaType: mediaType,
+		Digest:    digest,
+		Size:      size,
+	}
+	return
+}
+
+// close writes the index and the rest of the metadata files of the
+// layout.
+//
+func (l *ociLayout) close() error {
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"oci-layout", map[string]string{"imageLayoutVersion": "1.0.0"}},
+		{"index.json", l.index},
+		{"manifest.json", l.docker},
+	}
+	for _, file := range files {
+		data, err := json.MarshalIndent(file.content, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(l.dir, file.name), data, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobPath returns the path, relative to the root of the layout, of the
+// blob with the given digest.
+//
+func blobPath(digest string) string {
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+// readTarEntry calls the given function with a reader for the content of
+// the entry of the given tar file that has the given name.
+//
+func readTarEntry(archive, name string, read func(in io.Reader) error) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return fmt.Errorf("the entry '%s' doesn't exist", name)
+		}
+		if err != nil {
+			return err
+		}
+		if header.Name == name {
+			return read(reader)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+// This file contains functions used to process images concurrently,
+// respecting the dependencies between them.
+
+// ImageTask is the type of the functions that are executed for each
+// image by RunParallel.
+//
+type ImageTask func(image *Image) error
+
+// taskResult contains the result of executing a task for an image.
+//
+type taskResult struct {
+	image *Image
+	err   error
+}
+
+// RunParallel executes the given task for each of the given images,
+// running up to the given number of tasks concurrently. The task for an
+// image is only started once the tasks for all its dependencies have
+// finished successfully. Dependencies that aren't part of the given
+// slice of images are assumed to be already available.
+//
+// When a task fails no new tasks are started, the tasks that are
+// already running are waited for, and the error of the first failed
+// task is returned.
+//
+func RunParallel(images []*Image, jobs int, task ImageTask) error {
+	return runTasks(images, jobs, task, true)
+}
+
+// RunConcurrently executes the given task for each of the given images,
+// running up to the given number of tasks concurrently, without taking
+// into account the dependencies between the images. As RunParallel, when
+// a task fails no new tasks are started, and the error of the first
+// failed task is returned.
+//
+func RunConcurrently(images []*Image, jobs int, task ImageTask) error {
+	return runTasks(images, jobs, task, false)
+}
+
+// runTasks executes the given task for each of the given images. If
+// ordered is true the task for an image is started only once the tasks
+// for its dependencies have finished.
+//
+func runTasks(images []*Image, jobs int, task ImageTask, ordered bool) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	// Find, for each image, the images that depend on it and the
+	// number of dependencies that haven't been processed yet. When
+	// the order doesn't matter no image waits for any other:
+	included := make(map[*Image]bool)
+	for _, image := range images {
+		included[image] = true
+	}
+	children := make(map[*Image][]*Image)
+	waiting := make(map[*Image]int)
+	if ordered {
+		for _, image := range images {
+			for _, dependency := range image.Dependencies() {
+				if included[dependency] {
+					children[dependency] = append(children[dependency], image)
+					waiting[image]++
+				}
+			}
+		}
+	}
+
+	// The images that don't wait for any other image are ready to
+	// be processed immediately:
+	ready := []*Image{}
+	for _, image := range images {
+		if waiting[image] == 0 {
+			ready = append(ready, image)
+		}
+	}
+
+	// Start tasks while there are ready images and free slots, and
+	// every time that a task finishes check if any of the images
+	// that depend on it are now ready:
+	results := make(chan taskResult)
+	running := 0
+	var failure error
+	for {
+		for failure == nil && running < jobs && len(ready) > 0 {
+			image := ready[0]
+			ready = ready[1:]
+			running++
+			go func() {
+				results <- taskResult{
+					image: image,
+					err:   task(image),
+				}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+		result := <-results
+		running--
+		if result.err != nil {
+			if failure == nil {
+				failure = result.err
+			}
+			continue
+		}
+		for _, child := range children[result.image] {
+			waiting[child]--
+			if waiting[child] == 0 {
+				ready = append(ready, child)
+			}
+		}
+	}
+
+	return failure
+}
@@ -20,36 +20,110 @@ package build
 // the project configuration file.
 
 import (
-	"container/list"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/go-ini/ini"
+
+	"ovc/log"
 )
 
 // Project contains the project configuration.
 //
 type Project struct {
 	work      string
+	keep      bool
 	root      string
 	version   string
+	values    map[string]interface{}
+	config    *projectConfig
+	partials  []string
+	date      time.Time
+	sha       string
+	extracted bool
+	render    string
+	strict    bool
 	images    *ProjectImages
 	manifests *ProjectManifests
 }
 
+// ProjectOptions contains the options that control how a project is
+// loaded.
+//
+type ProjectOptions struct {
+	// The directory where the results of processing templates will
+	// be stored. If empty a temporary directory will be created, and
+	// it will be removed when the project is closed. If not empty the
+	// directory will be created if needed, and it will be kept when
+	// the project is closed.
+	WorkDir string
+
+	// The YAML files that contain values for the templates. Values
+	// in these files override the values in the project file, and
+	// values in later files override values in earlier files.
+	ValuesFiles []string
+
+	// Assignments of values for the templates, in the form
+	// 'NAME=VALUE', where the name can contain dots to indicate
+	// nested values, for example 'database.password=secret'. These
+	// override the values of the project file and of the values
+	// files.
+	SetValues []string
+
+	// The name of the configuration profile to apply on top of the
+	// project file. If empty the value of the 'OVC_PROFILE'
+	// environment variable will be used, and if that is also empty
+	// no profile will be applied.
+	Profile string
+
+	// Assignments of configuration values, in the form 'NAME=VALUE',
+	// where the name is the name of the section and the name of the
+	// key separated by a dot, for example 'images.registry'. These
+	// override the values of the project file, of the profile and of
+	// the environment.
+	Options []string
+
+	// The version of the project used when the 'version' parameter is
+	// 'auto'. If empty it will be calculated from the git repository
+	// that contains the project.
+	Version string
+
+	// The abbreviated identifier of the git commit of the project. If
+	// empty it will be calculated from the git repository that
+	// contains the project, when it is needed.
+	Commit string
+
+	// Indicates that the project has been extracted from the data
+	// embedded in the binary, so it isn't inside a git repository
+	// and the version and commit can't be calculated from it.
+	Extracted bool
+}
+
+// The name of the environment variable that contains the name of the
+// configuration profile.
+//
+const profileEnv = "OVC_PROFILE"
+
 // ProjectImages contains the information about the images that are part
 // of the project.
 //
 type ProjectImages struct {
-	project  *Project
-	path     string
-	prefix   string
-	registry string
-	list     []*Image
-	index    map[string]*Image
+	project    *Project
+	path       string
+	prefix     string
+	registry   string
+	tagFormats []*template.Template
+	engine     ContainerEngine
+	list       []*Image
+	index      map[string]*Image
 }
 
 // ProjectManifests contains the information about the manifests that
@@ -80,6 +154,79 @@ func (p *Project) Version() string {
 	return p.version
 }
 
+// Values returns the tree of values that is passed to the templates.
+//
+func (p *Project) Values() map[string]interface{} {
+	return p.values
+}
+
+// ConfigValue contains one of the values of the merged configuration of
+// the project, and where it came from.
+//
+type ConfigValue struct {
+	// The name of the section, empty for the global section.
+	Section string
+
+	// The name of the key.
+	Key string
+
+	// The effective value.
+	Value string
+
+	// Where the value came from: 'default', 'file', 'profile', 'env'
+	// or 'flag'.
+	Source string
+}
+
+// ConfigValues returns the values of the merged configuration of the
+// project, in the order that they appear in the configuration, and
+// excluding the profiles, as they have already been applied.
+//
+func (p *Project) ConfigValues() []*ConfigValue {
+	values := []*ConfigValue{}
+	for _, section := range p.config.file.Sections() {
+		if isProfileSection(section.Name()) {
+			continue
+		}
+		name := section.Name()
+		if name == ini.DEFAULT_SECTION {
+			name = ""
+		}
+		for _, key := range section.Keys() {
+			values = append(values, &ConfigValue{
+				Section: name,
+				Key:     key.Name(),
+				Value:   key.Value(),
+				Source:  p.config.source(section.Name(), key.Name()),
+			})
+		}
+	}
+	return values
+}
+
+// WriteConfig writes the merged configuration of the project to the
+// given writer, in the format of the project file, with a comment after
+// each value that indicates where it came from.
+//
+func (p *Project) WriteConfig(out io.Writer) error {
+	section := ""
+	for _, value := range p.ConfigValues() {
+		if value.Section != section {
+			section = value.Section
+			_, err := fmt.Fprintf(out, "\n[%s]\n", section)
+			if err != nil {
+				return err
+			}
+		}
+		line := fmt.Sprintf("%s=%s", value.Key, value.Value)
+		_, err := fmt.Fprintf(out, "%-50s # %s\n", line, value.Source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Images returns the information about the images that are part of the
 // project.
 //
@@ -122,6 +269,13 @@ func (pi *ProjectImages) Registry() string {
 	return pi.registry
 }
 
+// Engine returns the container engine used to build, store and push
+// the images.
+//
+func (pi *ProjectImages) Engine() ContainerEngine {
+	return pi.engine
+}
+
 // List returns a slice containing the images that are part of the
 // project, sorted in the right build order.
 //
@@ -136,6 +290,47 @@ func (pi *ProjectImages) Index() map[string]*Image {
 	return pi.index
 }
 
+// Select returns a slice containing the images that have the given
+// names, sorted in the right build order. If the descendants parameter
+// is true the images that are built on top of the selected images are
+// also included. If the list of names is empty all the images of the
+// project are returned.
+//
+func (pi *ProjectImages) Select(names []string, descendants bool) (selected []*Image, err error) {
+	if len(names) == 0 {
+		selected = pi.list
+		return
+	}
+	included := make(map[*Image]bool)
+	for _, name := range names {
+		image, present := pi.index[name]
+		if !present {
+			err = fmt.Errorf("Can't find image named '%s'", name)
+			return
+		}
+		if !image.options.Enabled {
+			err = fmt.Errorf("Image '%s' is disabled", name)
+			return
+		}
+		included[image] = true
+	}
+	selected = []*Image{}
+	for _, image := range pi.list {
+		if !included[image] && descendants {
+			for _, ancestor := range image.Ancestors() {
+				if included[ancestor] {
+					included[image] = true
+					break
+				}
+			}
+		}
+		if included[image] {
+			selected = append(selected, image)
+		}
+	}
+	return
+}
+
 // WorkingDirectory returns the absolute path of the working directory for the
 // OpenShift manifests of the project.
 //
@@ -150,11 +345,77 @@ func (pm *ProjectManifests) Directory() string {
 	return filepath.Join(pm.project.root, pm.path)
 }
 
+// UsedImages returns the images of the project whose tags appear in the
+// results of processing the templates of the manifests, sorted in build
+// order.
+//
+func (pm *ProjectManifests) UsedImages() (used []*Image, err error) {
+	found := make(map[*Image]bool)
+	err = filepath.Walk(pm.WorkingDirectory(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		text := string(data)
+		for _, image := range pm.project.images.list {
+			if containsTag(text, image.tag) {
+				found[image] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	used = []*Image{}
+	for _, image := range pm.project.images.list {
+		if found[image] {
+			used = append(used, image)
+		}
+	}
+	return
+}
+
+// containsTag checks if the given text contains the given tag, and
+// that it isn't just the beginning of a longer tag.
+//
+func containsTag(text, tag string) bool {
+	for {
+		index := strings.Index(text, tag)
+		if index < 0 {
+			return false
+		}
+		end := index + len(tag)
+		if end == len(text) || !isTagChar(rune(text[end])) {
+			return true
+		}
+		text = text[end:]
+	}
+}
+
+// isTagChar checks if the given character can be part of an image tag.
+//
+func isTagChar(char rune) bool {
+	return isNameChar(char) || strings.ContainsRune(".-:/@", char)
+}
+
 // Close releases all the resources used by the project, including the
 // temporary directory used to store the results of processsing
 // templates. Once the project is closed it can no longer be used.
 //
+// If the working directory was given explicitly when the project was
+// loaded then it isn't removed.
+//
 func (p *Project) Close() error {
+	if p.keep {
+		return nil
+	}
 	return os.RemoveAll(p.work)
 }
 
@@ -173,34 +434,70 @@ version=master
 prefix=ovirt
 directory=image-specifications
 registry=
+tags={{.Version}}
+engine=auto
 
 [manifests]
 directory=os-manifests
+
+[templates]
+partials=templates
+render=all
+strict=false
+
+[values]
+database.password=engine
+database.maxConnections=150
+engine.password=engine
+engine.pkiOrganization=oVirt
 `
 
 // LoadProject loads a project from the given path. If the path is empty
 // then it will load the project from the 'project.conf' file inside the
-// current working directory.
+// current working directory. The options parameter can be nil, and then
+// the default options will be used.
 //
-func LoadProject(path string) (project *Project, err error) {
+func LoadProject(path string, options *ProjectOptions) (project *Project, err error) {
 	var file *ini.File
 	var section *ini.Section
 
+	// Use the default options if none have been given:
+	if options == nil {
+		options = new(ProjectOptions)
+	}
+
 	// Create an initially empty project:
 	project = new(Project)
+	project.date = time.Now()
+	project.sha = options.Commit
+	project.extracted = options.Extracted
 
 	// Calculate the absolute path of the project:
 	root, _ := filepath.Abs(filepath.Dir(path))
 	project.root = root
 
-	// Create a temporary directory that will be used to store the
-	// results of generating files from templates, and maybe other
-	// temporary files.
-        project.work, err = ioutil.TempDir("", "work")
-        if err != nil {
-		err = fmt.Errorf("Can't create temporary work directory: %s\n", err)
-		return
-        }
+	// Create the directory that will be used to store the results
+	// of generating files from templates, and maybe other temporary
+	// files. If it hasn't been given explicitly use a temporary
+	// directory.
+	if options.WorkDir != "" {
+		project.work, err = filepath.Abs(options.WorkDir)
+		if err != nil {
+			return
+		}
+		project.keep = true
+		err = os.MkdirAll(project.work, 0755)
+		if err != nil {
+			err = fmt.Errorf("Can't create work directory '%s': %s\n", project.work, err)
+			return
+		}
+	} else {
+		project.work, err = ioutil.TempDir("", "work")
+		if err != nil {
+			err = fmt.Errorf("Can't create temporary work directory: %s\n", err)
+			return
+		}
+	}
 
 	// If the path is empty then use the current directory and the
 	// default project file name:
@@ -213,22 +510,77 @@ func LoadProject(path string) (project *Project, err error) {
 	}
 
 	// Load the default project data:
-	file = ini.Empty()
-	err = file.Append([]byte(defaultProjectData))
+	config, err := newProjectConfig()
+	if err != nil {
+		return
+	}
+	project.config = config
+
+	// Load the project file on top of the defaults:
+	loaded, err := ini.Load(path)
+	if err != nil {
+		return
+	}
+	err = config.merge(loaded, sourceFile)
 	if err != nil {
 		return
 	}
 
-	// Load the project file:
-	err = file.Append(path)
+	// Apply the profile on top of the project file. If it hasn't
+	// been given explicitly it is taken from the environment:
+	profile := options.Profile
+	if profile == "" {
+		profile = os.Getenv(profileEnv)
+	}
+	if profile != "" {
+		err = config.applyProfile(profile)
+		if err != nil {
+			return
+		}
+	}
+
+	// Apply the environment variables and then the options given
+	// explicitly, as they have the highest precedence:
+	err = config.applyEnv(project.root)
+	if err != nil {
+		return
+	}
+	err = config.applyOptions(options.Options)
+	if err != nil {
+		return
+	}
+
+	// Check that the merged configuration is valid:
+	err = config.validate()
 	if err != nil {
 		return
 	}
+	config.logSources()
+	file = config.file
 
 	// Copy the main parameters from the configuration to the
 	// project object:
 	section = file.Section("")
 	project.version = section.Key("version").MustString("")
+	if project.version == autoVersion {
+		project.version, err = projectVersion(project, options)
+		if err != nil {
+			return
+		}
+		log.Debug("Calculated project version '%s'", project.version)
+	}
+
+	// Load the values for the templates:
+	err = loadValues(file, project, options)
+	if err != nil {
+		return
+	}
+
+	// Load the template processing options:
+	err = loadTemplates(file, project)
+	if err != nil {
+		return
+	}
 
 	// Load the images:
 	err = loadImages(file, project)
@@ -245,6 +597,56 @@ func LoadProject(path string) (project *Project, err error) {
 	return
 }
 
+// gitSHA returns the abbreviated identifier of the current commit of the
+// git repository that contains the project. It is calculated only the
+// first time that it is needed, unless it was given in the options. If
+// the project has been extracted from the binary there is no git
+// repository, so it is only available if it was given in the options.
+//
+func (p *Project) gitSHA() (sha string, err error) {
+	if p.sha == "" {
+		if p.extracted {
+			err = fmt.Errorf(
+				"The git commit isn't available because the project has been " +
+					"extracted from the binary, and the binary doesn't contain it",
+			)
+			return
+		}
+		p.sha, err = gitSHA(p.root)
+	}
+	sha = p.sha
+	return
+}
+
+// projectVersion returns the version of the project when the 'version'
+// parameter is 'auto'. The version given in the options has precedence,
+// and if there is none it is calculated from the git repository. The
+// result is normalized so that it can be used in image tags.
+//
+func projectVersion(project *Project, options *ProjectOptions) (version string, err error) {
+	switch {
+	case options.Version != "":
+		version = options.Version
+	case options.Extracted:
+		log.Warning(
+			"The project has been extracted from the binary, and the binary "+
+				"doesn't contain the version, will use '%s'",
+			devVersion,
+		)
+		version = devVersion
+	default:
+		version, err = gitVersion(project.root)
+		if err != nil {
+			return
+		}
+	}
+	version = normalizeVersion(version)
+	if version == "" {
+		err = fmt.Errorf("The version of the project doesn't contain any valid tag character")
+	}
+	return
+}
+
 // Regular expression used to extract the name and version of an image
 // from the value of the FROM instruction of a Dockerfile.
 //
@@ -253,13 +655,13 @@ var fromRe = regexp.MustCompile("^(?P<prefix>.*)/(?P<name>[^/]+):(?P<version>[^:
 // loadImages images scans the images directory, loads the descriptions
 // and stores them into the project.
 //
-// The images will have their parent resolved, but only if the parent is
-// also in the same images directory, otherwise it will be nil.
+// The images will have their dependencies resolved, but only the
+// dependencies that are also in the same images directory.
 //
 func loadImages(file *ini.File, project *Project) error {
 	// Check that the 'images' section is available:
-	section := file.Section("images")
-	if section == nil {
+	section, err := file.GetSection("images")
+	if err != nil {
 		return fmt.Errorf("The project configuration doesn't contain the 'images' section\n")
 	}
 
@@ -271,6 +673,27 @@ func loadImages(file *ini.File, project *Project) error {
 	images.prefix = section.Key("prefix").MustString("")
 	images.registry = section.Key("registry").MustString("")
 
+	// Parse the formats of the tags:
+	formats := splitTagFormats(section.Key("tags").String())
+	if len(formats) == 0 {
+		return fmt.Errorf("The project configuration doesn't contain any tag format")
+	}
+	for _, format := range formats {
+		tmpl, err := template.New(format).Option("missingkey=error").Parse(format)
+		if err != nil {
+			return fmt.Errorf("Can't parse tag format '%s': %s", format, err)
+		}
+		images.tagFormats = append(images.tagFormats, tmpl)
+	}
+
+	// Create the container engine:
+	engine, err := NewContainerEngine(section.Key("engine").MustString(""))
+	if err != nil {
+		return err
+	}
+	images.engine = engine
+	log.Debug("Using container engine '%s'", images.engine.Name())
+
 	// The source files of images may be templates, and those
 	// templates may refer to some properties of other images. In
 	// particular the Dockerfile of one image may refer to its
@@ -282,59 +705,398 @@ func loadImages(file *ini.File, project *Project) error {
 	// of the images, to have at least the name. After that we can
 	// load the image details, which will process the templates.
 	images.list = []*Image{}
-	paths, err := filepath.Glob(filepath.Join(project.root, images.path, "*"))
+	names, err := imageNames(filepath.Join(project.root, images.path))
 	if err != nil {
 		return err
 	}
-	for _, path := range paths {
-		info, err := os.Stat(path)
+	for _, name := range names {
+		images.list = append(images.list, NewImage(project, name))
+	}
+	images.index = make(map[string]*Image)
+	for _, image := range images.list {
+		images.index[image.name] = image
+	}
+
+	// Load the options of the images, as they may change the names
+	// used in the tags:
+	err = loadImageOptions(file, project)
+	if err != nil {
+		return err
+	}
+
+	// Calculate the tags of all the images before processing the
+	// templates of any of them, so that the templates can refer to
+	// any image, including the ones that are disabled:
+	for _, image := range images.list {
+		err = image.calculateTags()
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
-			image := NewImage(project, filepath.Base(path))
-			if err != nil {
-				return err
-			}
-			images.list = append(images.list, image)
-		}
 	}
-	images.index = make(map[string]*Image)
+	err = checkRepositories(images.list)
+	if err != nil {
+		return err
+	}
+
+	// Disabled images stay in the index, so that their tags can be
+	// used, but they aren't loaded, built, saved, pushed or removed:
+	enabled := []*Image{}
 	for _, image := range images.list {
-		images.index[image.name] = image
+		if image.options.Enabled {
+			enabled = append(enabled, image)
+		} else {
+			log.Debug("Image '%s' is disabled", image.name)
+		}
 	}
+	images.list = enabled
 
 	// Now that we have the names of all the images, we can process
 	// load the details of the images.
 	for _, image := range images.list {
-		image.Load()
+		err = image.Load()
+		if err != nil {
+			return fmt.Errorf("Can't load image '%s': %s", image.name, err)
+		}
 	}
 
-	// Resolve the references to parent images, using the FROM
-	// instruction:
+	// Resolve the dependencies between images, using the FROM
+	// instructions of all the stages and the '--from' flags:
 	for _, image := range project.images.list {
-		from := image.Dockerfile().From()
-		if from == "" {
+		err = resolveDependencies(image)
+		if err != nil {
+			return fmt.Errorf("Can't resolve dependencies of image '%s': %s", image.name, err)
+		}
+	}
+
+	// Sort the loaded images in build order:
+	return sortImages(project.images.list)
+}
+
+// splitTagFormats splits the value of the 'tags' option into the list of
+// formats. Formats are separated by commas, but commas inside template
+// actions, like in '{{ printf "%s-%s" .Version .Name }}', are part of
+// the format, as they can't appear in the text of a tag.
+//
+func splitTagFormats(value string) []string {
+	formats := []string{}
+	action := false
+	quote := byte(0)
+	start := 0
+	add := func(format string) {
+		format = strings.TrimSpace(format)
+		if format != "" {
+			formats = append(formats, format)
+		}
+	}
+	for i := 0; i < len(value); i++ {
+		char := value[i]
+		switch {
+		case quote != 0:
+			if char == '\\' && quote != '`' {
+				i++
+			} else if char == quote {
+				quote = 0
+			}
+		case !action && strings.HasPrefix(value[i:], "{{"):
+			action = true
+			i++
+		case action && strings.HasPrefix(value[i:], "}}"):
+			action = false
+			i++
+		case action && (char == '"' || char == '\'' || char == '`'):
+			quote = char
+		case !action && char == ',':
+			add(value[start:i])
+			start = i + 1
+		}
+	}
+	add(value[start:])
+	return formats
+}
+
+// resolveDependencies finds the images of the project that are
+// referenced from the Dockerfile of the given image, and stores them,
+// sorted by name, as the dependencies of the image. The references to
+// images that aren't part of the project are stored as the external
+// dependencies of the image.
+//
+func resolveDependencies(image *Image) error {
+	image.dependencies = []*Image{}
+	image.externals = []string{}
+	if image.dockerfile == nil {
+		return nil
+	}
+	references, err := image.dockerfile.References()
+	if err != nil {
+		return err
+	}
+	found := make(map[*Image]bool)
+	for _, reference := range references {
+		dependency, err := image.project.images.find(reference)
+		if err != nil {
+			return err
+		}
+		if dependency == nil {
+			warnMissingImage(image, reference)
+			image.externals = append(image.externals, reference)
+			continue
+		}
+		if !dependency.options.Enabled {
+			// Disabled images are treated as external images,
+			// assuming that they are available in the registry:
+			image.externals = append(image.externals, reference)
+			continue
+		}
+		if found[dependency] {
 			continue
 		}
-		groups := FindRegexpGroups(from, fromRe)
-		if groups == nil {
+		found[dependency] = true
+		image.dependencies = append(image.dependencies, dependency)
+	}
+	sort.Slice(image.dependencies, func(i, j int) bool {
+		return image.dependencies[i].name < image.dependencies[j].name
+	})
+	return nil
+}
+
+// warnMissingImage writes a warning to the log if the given reference,
+// that doesn't correspond to any image of the project, uses the prefix
+// of the project. That usually means that the name of the image is
+// wrong, or that the directory of the image has been removed.
+//
+func warnMissingImage(image *Image, reference string) {
+	groups := FindRegexpGroups(reference, fromRe)
+	if len(groups) == 0 || !image.project.images.hasPrefix(groups["prefix"]) {
+		return
+	}
+	log.Warning(
+		"Image '%s' refers to '%s', which uses the project prefix '%s', "+
+			"but there is no image named '%s' in directory '%s'",
+		image.name,
+		reference,
+		image.project.images.prefix,
+		groups["name"],
+		image.project.images.Directory(),
+	)
+}
+
+// hasPrefix checks if the given prefix, extracted from an image
+// reference, corresponds to the prefix of the project, with or without
+// the registry.
+//
+func (pi *ProjectImages) hasPrefix(prefix string) bool {
+	return prefix == pi.prefix || prefix == pi.registry+"/"+pi.prefix
+}
+
+// find returns the image of the project that corresponds to the given
+// image reference, or nil if the reference doesn't correspond to any
+// image of the project. The reference can be any of the tags of the
+// image, or a tag without the registry. Disabled images are included.
+// Images are checked in order of name, and if a reference without the
+// registry matches images of different registries it is an error, as
+// the result would depend on that order.
+//
+func (pi *ProjectImages) find(reference string) (result *Image, err error) {
+	names := make([]string, 0, len(pi.index))
+	for name := range pi.index {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		image := pi.index[name]
+		for _, tag := range image.tags {
+			if tag == reference {
+				result = image
+				return
+			}
+		}
+	}
+	groups := FindRegexpGroups(reference, fromRe)
+	if len(groups) == 0 {
+		return
+	}
+	for _, key := range names {
+		image := pi.index[key]
+		registry, prefix, name := image.tagParts()
+		if groups["name"] != name {
 			continue
 		}
-		prefix := groups["prefix"]
-		if prefix != project.Images().Prefix() {
+		if groups["prefix"] != prefix && groups["prefix"] != registry+"/"+prefix {
 			continue
 		}
-		name := groups["name"]
-		parent := project.images.index[name]
-		if parent != nil {
-			image.parent = parent
+		if result != nil {
+			err = fmt.Errorf(
+				"Reference '%s' matches images '%s' and '%s', use the complete tag",
+				reference,
+				result.name,
+				image.name,
+			)
+			result = nil
+			return
 		}
+		result = image
 	}
+	return
+}
 
-	// Sort the loaded images in build order:
-	sortImages(project.images.list)
+// checkRepositories checks that the given images don't use the same
+// registry, prefix and name in their tags, as then it wouldn't be
+// possible to distinguish them.
+//
+func checkRepositories(images []*Image) error {
+	used := make(map[string]*Image)
+	for _, image := range images {
+		registry, prefix, name := image.tagParts()
+		repository := fmt.Sprintf("%s/%s/%s", registry, prefix, name)
+		if other, present := used[repository]; present {
+			return fmt.Errorf(
+				"Images '%s' and '%s' have the same name '%s' in their tags",
+				other.name,
+				image.name,
+				name,
+			)
+		}
+		used[repository] = image
+	}
+	return nil
+}
+
+// The name of the section of the project configuration that contains
+// the default build options for all the images, and the prefix of the
+// sections that contain the build options of specific images, for
+// example:
+//
+//	[image]
+//	pull=true
+//
+//	[image "engine"]
+//	arg.DOCKERIZE_VERSION=v0.2.0
+//
+const imageSection = "image"
+
+// Prefixes of the keys that contain build arguments and labels.
+//
+const (
+	argKeyPrefix   = "arg."
+	labelKeyPrefix = "label."
+)
+
+// imageNames returns the names of the images contained in the given
+// images directory, which are the names of its subdirectories.
+//
+func imageNames(dir string) (names []string, err error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		var info os.FileInfo
+		info, err = os.Stat(path)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	return
+}
+
+// loadImageOptions loads the build options of the images from the
+// default image section and from the sections specific for each image.
+//
+func loadImageOptions(file *ini.File, project *Project) error {
+	// Check that all the sections correspond to existing images, as
+	// otherwise a typo in the name of an image would be silently
+	// ignored:
+	for _, section := range file.Sections() {
+		name, ok := imageSectionName(section.Name())
+		if !ok {
+			continue
+		}
+		if _, present := project.images.index[name]; !present {
+			return fmt.Errorf(
+				"The project configuration contains options for image '%s', but it doesn't exist",
+				name,
+			)
+		}
+	}
 
+	// Load the default options first, and then the options specific
+	// for each image, that override the defaults:
+	for _, image := range project.images.list {
+		sections := []string{
+			imageSection,
+			fmt.Sprintf("%s \"%s\"", imageSection, image.name),
+		}
+		for _, name := range sections {
+			section, err := file.GetSection(name)
+			if err != nil {
+				continue
+			}
+			err = loadImageOptionsSection(section, image.options)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// imageSectionName checks if the given section name has the form used
+// for image specific options, and returns the name of the image.
+//
+func imageSectionName(section string) (name string, ok bool) {
+	prefix := imageSection + " \""
+	if !strings.HasPrefix(section, prefix) || !strings.HasSuffix(section, "\"") {
+		return
+	}
+	name = section[len(prefix) : len(section)-1]
+	ok = name != ""
+	return
+}
+
+// loadImageOptionsSection loads build options from the given section,
+// overriding the values that are already present.
+//
+func loadImageOptionsSection(section *ini.Section, options *ImageOptions) error {
+	var err error
+	for _, key := range section.Keys() {
+		name := key.Name()
+		switch {
+		case strings.HasPrefix(name, argKeyPrefix):
+			options.Args[strings.TrimPrefix(name, argKeyPrefix)] = key.String()
+		case strings.HasPrefix(name, labelKeyPrefix):
+			options.Labels[strings.TrimPrefix(name, labelKeyPrefix)] = key.String()
+		case name == "target":
+			options.Target = key.String()
+		case name == "no-cache":
+			options.NoCache, err = key.Bool()
+		case name == "pull":
+			options.Pull, err = key.Bool()
+		case name == "enabled":
+			options.Enabled, err = key.Bool()
+		case name == "name" && section.Name() == imageSection:
+			err = fmt.Errorf("The name can only be given for a specific image")
+		case name == "name":
+			options.Name = key.String()
+		case name == "prefix":
+			options.Prefix = key.String()
+		case name == "registry":
+			options.Registry = key.String()
+		default:
+			err = fmt.Errorf("Unknown build option")
+		}
+		if err != nil {
+			return fmt.Errorf(
+				"Can't load key '%s' of section '%s': %s",
+				name,
+				section.Name(),
+				err,
+			)
+		}
+	}
 	return nil
 }
 
@@ -347,7 +1109,7 @@ func loadImage(image *Image) error {
 	path := filepath.Join(image.Directory(), "Dockerfile")
 	if _, err := os.Stat(path); err == nil {
 		image.dockerfile = NewDockerfile()
-		image.dockerfile.Load(path)
+		return image.dockerfile.Load(path)
 	}
 
 	return nil
@@ -355,31 +1117,128 @@ func loadImage(image *Image) error {
 
 
 // sortImages implements a topological sort of the images according to
-// their dependencies. If image A is the base for image B, then image A
-// is guaranteed to appear before imabe B in the sorted slice. this is
-// intended to be able to build images in the right order.
-//
-func sortImages(images []*Image) {
-	index := 0
-	visited := make(map[*Image]bool)
-	visited[nil] = true
-	pending := list.New()
+// their dependencies. If image A is a dependency of image B, then image
+// A is guaranteed to appear before imabe B in the sorted slice. this is
+// intended to be able to build images in the right order. Images that
+// don't depend on each other keep their relative order.
+//
+// If the dependencies contain a cycle then it returns an error that
+// contains the complete path of the cycle, for example 'a -> b -> a'.
+//
+func sortImages(images []*Image) error {
+	// States of the images during the depth first traversal:
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	sorted := make([]*Image, 0, len(images))
+	states := make(map[*Image]int)
+	path := []*Image{}
+	var visit func(image *Image) error
+	visit = func(image *Image) error {
+		switch states[image] {
+		case visited:
+			return nil
+		case visiting:
+			return cycleError(path, image)
+		}
+		states[image] = visiting
+		path = append(path, image)
+		for _, dependency := range image.dependencies {
+			err := visit(dependency)
+			if err != nil {
+				return err
+			}
+		}
+		path = path[0 : len(path)-1]
+		states[image] = visited
+		sorted = append(sorted, image)
+		return nil
+	}
 	for _, image := range images {
-		visited[image] = false
-		pending.PushBack(image)
-	}
-	for pending.Len() > 0 {
-		current := pending.Remove(pending.Front()).(*Image)
-		parent := current.Parent()
-		if visited[parent] {
-			visited[current] = true
-			images[index] = current
-			index++
-		} else {
-			pending.PushBack(parent)
-			pending.PushBack(current)
+		err := visit(image)
+		if err != nil {
+			return err
 		}
 	}
+	copy(images, sorted)
+	return nil
+}
+
+// cycleError creates the error that describes a dependency cycle. The
+// path parameter contains the images visited so far, and the image
+// parameter is the image that closes the cycle.
+//
+func cycleError(path []*Image, image *Image) error {
+	start := 0
+	for path[start] != image {
+		start++
+	}
+	names := []string{}
+	for _, current := range path[start:] {
+		names = append(names, current.name)
+	}
+	names = append(names, image.name)
+	return fmt.Errorf(
+		"The dependencies of the images contain a cycle: %s",
+		strings.Join(names, " -> "),
+	)
+}
+
+// loadTemplates loads the options that control how templates are
+// processed, and finds the files of the partials directory. These files
+// contain the definitions of templates that can be used from any of the
+// files of the image specifications or the manifests. The directory is
+// optional, if it doesn't exist then there are no partials.
+//
+func loadTemplates(file *ini.File, project *Project) error {
+	section := file.Section("templates")
+
+	// Get the processing options:
+	project.render = section.Key("render").MustString(renderAll)
+	if project.render != renderAll && project.render != renderSuffix {
+		return fmt.Errorf(
+			"Unknown template render mode '%s', should be '%s' or '%s'",
+			project.render,
+			renderAll,
+			renderSuffix,
+		)
+	}
+	project.strict = section.Key("strict").MustBool(false)
+
+	// Get the partials directory, relative to the project directory:
+	dir := section.Key("partials").MustString("")
+	if dir == "" {
+		return nil
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(project.root, dir)
+	}
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		log.Debug("Partials directory '%s' doesn't exist", dir)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Partials directory '%s' isn't a directory", dir)
+	}
+
+	// Find the files:
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			log.Debug("Found partial template file '%s'", path)
+			project.partials = append(project.partials, path)
+		}
+		return nil
+	})
 }
 
 // loadManifests images scans the OpenShift manifests directory, loads
@@ -387,8 +1246,8 @@ func sortImages(images []*Image) {
 //
 func loadManifests(file *ini.File, project *Project) error {
 	// Check that the 'manifests' section is available:
-	section := file.Section("manifests")
-	if section == nil {
+	section, err := file.GetSection("manifests")
+	if err != nil {
 		return fmt.Errorf("The project configuration doesn't contain the 'manifests' section\n")
 	}
 
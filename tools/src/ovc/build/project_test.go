@@ -0,0 +1,147 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitTagFormats(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []string
+	}{
+		{
+			value:    "{{.Version}}",
+			expected: []string{"{{.Version}}"},
+		},
+		{
+			value:    "{{.Version}}, {{.GitSHA}} ,latest",
+			expected: []string{"{{.Version}}", "{{.GitSHA}}", "latest"},
+		},
+		{
+			value:    `{{printf "%s-%s" .Version .GitSHA}},latest`,
+			expected: []string{`{{printf "%s-%s" .Version .GitSHA}}`, "latest"},
+		},
+		{
+			value:    `{{printf "a}},b" .Version}},{{.Date}}`,
+			expected: []string{`{{printf "a}},b" .Version}}`, "{{.Date}}"},
+		},
+		{
+			value:    `{{printf "\",}}" .Version}},{{.Name}}`,
+			expected: []string{`{{printf "\",}}" .Version}}`, "{{.Name}}"},
+		},
+		{
+			value:    "{{index .Values `a,b`}},,latest,",
+			expected: []string{"{{index .Values `a,b`}}", "latest"},
+		},
+		{
+			value:    "",
+			expected: []string{},
+		},
+	}
+	for _, test := range tests {
+		actual := splitTagFormats(test.value)
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Expected formats %q for '%s', got %q", test.expected, test.value, actual)
+		}
+	}
+}
+
+func TestFindImage(t *testing.T) {
+	// Create a project with two images that have the same prefix and
+	// name, but different registries, so that references without the
+	// registry are ambiguous:
+	project := &Project{}
+	images := &ProjectImages{
+		project:  project,
+		prefix:   "ovirt",
+		registry: "registry.example.com",
+		index:    make(map[string]*Image),
+	}
+	project.images = images
+	add := func(name string, options *ImageOptions, tags ...string) {
+		images.index[name] = &Image{
+			project: project,
+			name:    name,
+			tag:     tags[0],
+			tags:    tags,
+			options: options,
+		}
+	}
+	mirror := NewImageOptions()
+	mirror.Name = "engine"
+	mirror.Registry = "mirror.example.com"
+	add("engine", NewImageOptions(), "registry.example.com/ovirt/engine:master")
+	add("mirror", mirror, "mirror.example.com/ovirt/engine:master")
+	add("database", NewImageOptions(), "registry.example.com/ovirt/database:master")
+
+	tests := []struct {
+		reference string
+		expected  string
+		err       string
+	}{
+		{
+			reference: "registry.example.com/ovirt/engine:master",
+			expected:  "engine",
+		},
+		{
+			reference: "mirror.example.com/ovirt/engine:master",
+			expected:  "mirror",
+		},
+		{
+			reference: "ovirt/database:other",
+			expected:  "database",
+		},
+		{
+			reference: "mirror.example.com/ovirt/engine:other",
+			expected:  "mirror",
+		},
+		{
+			reference: "ovirt/engine:other",
+			err:       "matches images 'engine' and 'mirror'",
+		},
+		{
+			reference: "centos:7",
+		},
+	}
+	for _, test := range tests {
+		// Repeat the lookup, as the order of iteration of maps is
+		// random and the result shouldn't depend on it:
+		for i := 0; i < 20; i++ {
+			image, err := images.find(test.reference)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected an error containing '%s' for '%s', got '%v'", test.err, test.reference, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error for '%s': %s", test.reference, err)
+			}
+			name := ""
+			if image != nil {
+				name = image.name
+			}
+			if name != test.expected {
+				t.Fatalf("Expected image '%s' for '%s', got '%s'", test.expected, test.reference, name)
+			}
+		}
+	}
+}
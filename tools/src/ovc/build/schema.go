@@ -0,0 +1,217 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+// This file contains the description of the sections and keys that are
+// accepted in the configuration of the project, and the functions that
+// check the configuration against it.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// valueChecker is the type of the functions that check that the value
+// of a key of the configuration is valid.
+//
+type valueChecker func(key *ini.Key) error
+
+// checkString accepts any value.
+//
+func checkString(key *ini.Key) error {
+	return nil
+}
+
+// checkBool checks that the value is a boolean, like 'true' or 'false'.
+//
+func checkBool(key *ini.Key) error {
+	_, err := key.Bool()
+	if err != nil {
+		return fmt.Errorf("it should be a boolean")
+	}
+	return nil
+}
+
+// checkEnum returns a function that checks that the value is one of the
+// given values.
+//
+func checkEnum(values ...string) valueChecker {
+	return func(key *ini.Key) error {
+		for _, value := range values {
+			if key.Value() == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("it should be one of '%s'", strings.Join(values, "', '"))
+	}
+}
+
+// sectionSchema describes the keys that are accepted in a section. Keys
+// with names that start with one of the prefixes are accepted as well.
+// If free is true then any key is accepted.
+//
+type sectionSchema struct {
+	keys     map[string]valueChecker
+	prefixes map[string]valueChecker
+	free     bool
+}
+
+// The schemas of the sections with fixed names.
+//
+var configSchema = map[string]*sectionSchema{
+	ini.DEFAULT_SECTION: {
+		keys: map[string]valueChecker{
+			"version": checkString,
+		},
+	},
+	"images": {
+		keys: map[string]valueChecker{
+			"prefix":    checkString,
+			"directory": checkString,
+			"registry":  checkString,
+			"tags":      checkString,
+			"engine":    checkEnum(append([]string{"auto"}, engineNames...)...),
+		},
+	},
+	"manifests": {
+		keys: map[string]valueChecker{
+			"directory": checkString,
+		},
+	},
+	"templates": {
+		keys: map[string]valueChecker{
+			"partials": checkString,
+			"render":   checkEnum(renderAll, renderSuffix),
+			"strict":   checkBool,
+		},
+	},
+	valuesSection: {
+		free: true,
+	},
+	imageSection: imageSchema,
+}
+
+// The schema of the sections that contain the build options of the
+// images, both the default section and the section of each image.
+//
+var imageSchema = &sectionSchema{
+	keys: map[string]valueChecker{
+		"target":   checkString,
+		"no-cache": checkBool,
+		"pull":     checkBool,
+		"enabled":  checkBool,
+		"name":     checkString,
+		"prefix":   checkString,
+		"registry": checkString,
+	},
+	prefixes: map[string]valueChecker{
+		argKeyPrefix:   checkString,
+		labelKeyPrefix: checkString,
+	},
+}
+
+// findSchema returns the schema of the section with the given name, or
+// nil if the section isn't known.
+//
+func findSchema(section string) *sectionSchema {
+	if _, ok := imageSectionName(section); ok {
+		return imageSchema
+	}
+	return configSchema[section]
+}
+
+// checkKey checks that the given key is accepted in the given section,
+// and that its value is valid.
+//
+func checkKey(section string, key *ini.Key) error {
+	schema := findSchema(section)
+	if schema == nil {
+		return fmt.Errorf("the section '%s' isn't known", section)
+	}
+	if schema.free {
+		return nil
+	}
+	checker := schema.keys[key.Name()]
+	if checker == nil {
+		for prefix, prefixChecker := range schema.prefixes {
+			if strings.HasPrefix(key.Name(), prefix) {
+				checker = prefixChecker
+				break
+			}
+		}
+	}
+	if checker == nil {
+		return fmt.Errorf("the key isn't known")
+	}
+	return checker(key)
+}
+
+// validate checks that all the sections and keys of the configuration
+// are known, and that their values are valid. The keys of the profiles
+// are checked as if they were in the sections that they override.
+//
+func (c *projectConfig) validate() error {
+	for _, section := range c.file.Sections() {
+		if isProfileSection(section.Name()) {
+			for _, key := range section.Keys() {
+				err := checkProfileKey(key)
+				if err != nil {
+					return fmt.Errorf(
+						"Key '%s' of section '%s' isn't valid: %s",
+						key.Name(),
+						section.Name(),
+						err,
+					)
+				}
+			}
+			continue
+		}
+		if findSchema(section.Name()) == nil {
+			return fmt.Errorf("Unknown configuration section '%s'", section.Name())
+		}
+		for _, key := range section.Keys() {
+			err := checkKey(section.Name(), key)
+			if err != nil {
+				return fmt.Errorf(
+					"Configuration key '%s' from %s isn't valid: %s",
+					keyName(section.Name(), key.Name()),
+					c.source(section.Name(), key.Name()),
+					err,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// checkProfileKey checks that the section and key overridden by the
+// given key of a profile are known, and that the value is valid for
+// them.
+//
+func checkProfileKey(key *ini.Key) error {
+	section, name, err := splitProfileKey(key.Name())
+	if err != nil {
+		return err
+	}
+	target, err := ini.Empty().Section(section).NewKey(name, key.Value())
+	if err != nil {
+		return err
+	}
+	return checkKey(section, target)
+}
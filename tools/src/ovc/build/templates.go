@@ -20,8 +20,11 @@ package build
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
 
 	"ovc/log"
@@ -32,41 +35,276 @@ import (
 //
 type Context struct {
 	project *Project
+
+	// The values loaded from the project file, from the values
+	// files and from the command line, available to templates as
+	// '.Values'.
+	Values map[string]interface{}
+}
+
+// Names of the files that contain the patterns of the files that are
+// copied verbatim instead of processed as templates.
+//
+var ignoreFiles = []string{
+	".ovcignore",
+	".templateignore",
+}
+
+// The suffix of the names of the files that are always processed as
+// templates. The suffix is removed from the name of the result.
+//
+const templateSuffix = ".tmpl"
+
+// Supported values of the 'render' option of the 'templates' section
+// of the project file.
+//
+const (
+	// All the files are processed as templates, except the ones
+	// that match the patterns of the ignore files.
+	renderAll = "all"
+
+	// Only the files with the '.tmpl' suffix are processed as
+	// templates, the rest are copied verbatim.
+	renderSuffix = "tmpl"
+)
+
+// ignoreRule contains a pattern read from an ignore file, and the
+// directory that contains that file, as the pattern is relative to it.
+//
+type ignoreRule struct {
+	dir     string
+	pattern string
 }
 
 // ProcessTemplates scans all the files in the input directory,
 // processes them as templates, and writes the result to the output
 // directory.
 //
+// Files whose name ends with '.tmpl' are always processed as templates,
+// and the suffix is removed from the name of the result. The rest of
+// the files are processed as templates only if the 'render' option of
+// the project is 'all', the default, and they don't match any of the
+// patterns of the '.ovcignore' or '.templateignore' files of their
+// directory or of the directories above it, up to the input directory.
+// Files that aren't processed are copied verbatim.
+//
 func ProcessTemplates(project *Project, inDir string, outDir string) error {
-	return filepath.Walk(inDir, func(inPath string, info os.FileInfo, err error) error {
-		path, err := filepath.Rel(inDir, inPath)
+	return processDirectory(project, inDir, outDir, nil)
+}
+
+// processDirectory processes the templates of one directory, and then
+// recursively of its subdirectories. The rules parameter contains the
+// ignore rules inherited from the directories above.
+//
+func processDirectory(project *Project, inDir, outDir string, rules []ignoreRule) error {
+	// Create the output directory, with the same permissions than
+	// the input directory:
+	info, err := os.Stat(inDir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(outDir, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	// Add the rules of the ignore files of this directory:
+	for _, name := range ignoreFiles {
+		loaded, err := loadIgnoreRules(filepath.Join(inDir, name))
 		if err != nil {
 			return err
 		}
-		outPath := filepath.Join(outDir, path)
+		rules = append(rules, loaded...)
+	}
+
+	// Process the entries of the directory:
+	entries, err := ioutil.ReadDir(inDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if isIgnoreFile(name) {
+			continue
+		}
+		inPath := filepath.Join(inDir, name)
+		outPath := filepath.Join(outDir, name)
+		ignored := matchIgnoreRules(rules, inPath)
+		switch {
+		case entry.IsDir() && ignored:
+			err = CopyDirectory(inPath, outPath)
+		case entry.IsDir():
+			err = processDirectory(project, inPath, outPath, rules)
+		case strings.HasSuffix(name, templateSuffix):
+			outPath = strings.TrimSuffix(outPath, templateSuffix)
+			err = ProcessTemplate(project, inPath, outPath)
+		case ignored || project.render == renderSuffix:
+			err = copyFile(inPath, outPath)
+		default:
+			err = ProcessTemplate(project, inPath, outPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isIgnoreFile checks if the given file name is the name of one of the
+// ignore files.
+//
+func isIgnoreFile(name string) bool {
+	for _, ignoreFile := range ignoreFiles {
+		if name == ignoreFile {
+			return true
+		}
+	}
+	return false
+}
+
+// loadIgnoreRules loads the patterns from the given ignore file. Empty
+// lines and lines starting with '#' are ignored. If the file doesn't
+// exist the result is empty.
+//
+func loadIgnoreRules(path string) (rules []ignoreRule, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	log.Debug("Loading ignore patterns from file '%s'", path)
+	dir := filepath.Dir(path)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSuffix(line, "/")
+		_, err = filepath.Match(line, "")
+		if err != nil {
+			err = fmt.Errorf("Pattern '%s' of ignore file '%s' isn't valid: %s", line, path, err)
+			return
+		}
+		rules = append(rules, ignoreRule{
+			dir:     dir,
+			pattern: line,
+		})
+	}
+	return
+}
+
+// matchIgnoreRules checks if the given path matches any of the given
+// rules. Patterns that don't contain slashes are matched against the
+// name of the file, and patterns that contain slashes are matched
+// against the path of the file relative to the directory of the ignore
+// file.
+//
+func matchIgnoreRules(rules []ignoreRule, path string) bool {
+	for _, rule := range rules {
+		target := filepath.Base(path)
+		if strings.Contains(rule.pattern, "/") {
+			relative, err := filepath.Rel(rule.dir, path)
+			if err != nil {
+				continue
+			}
+			target = filepath.ToSlash(relative)
+		}
+		matched, _ := filepath.Match(rule.pattern, target)
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// CopyDirectory copies a directory and all its contents verbatim.
+//
+func CopyDirectory(in string, out string) error {
+	return filepath.Walk(in, func(inPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		path, err := filepath.Rel(in, inPath)
+		if err != nil {
+			return err
+		}
+		outPath := filepath.Join(out, path)
 		if info.IsDir() {
-			return os.MkdirAll(outPath, info.Mode())
+			return os.MkdirAll(outPath, info.Mode().Perm())
 		}
-		return ProcessTemplate(project, inPath, outPath)
+		return copyFile(inPath, outPath)
 	})
 }
 
+// copyFile copies a file verbatim, preserving its permissions.
+//
+func copyFile(in string, out string) error {
+	log.Debug("Copying file '%s' to '%s'", in, out)
+	source, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	target, err := createFile(out, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	_, err = io.Copy(target, source)
+	return err
+}
+
+// createFile creates the given file, or truncates it if it already
+// exists, and sets the given permissions, even if the file already
+// existed or the umask would change them.
+//
+func createFile(path string, mode os.FileMode) (file *os.File, err error) {
+	file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return
+	}
+	err = file.Chmod(mode.Perm())
+	if err != nil {
+		file.Close()
+		file = nil
+	}
+	return
+}
+
 // ProcessTemplate loads the input file, processes it as a template, and
-// writes the result to the output file.
+// writes the result to the output file. If the project is in strict
+// mode then using a key that doesn't exist in a map, for example in
+// '.Values', is an error.
 //
 func ProcessTemplate(project *Project, in string, out string) error {
 	// Prepare the context object used for template evaluation:
 	ctx := new(Context)
 	ctx.project = project
+	ctx.Values = project.Values()
 
 	// Create the template and register the functions:
 	tmpl := template.New(filepath.Base(in))
-	tmpl.Funcs(template.FuncMap{
-		"tag": func(name string) (string, error) {
-			return tagFunc(ctx, name)
-		},
-	})
+	tmpl.Funcs(templateFuncs(ctx, tmpl))
+	if project.strict {
+		tmpl.Option("missingkey=error")
+	}
+
+	// Parse the partial templates first, so that the templates that
+	// they define can be used from the file:
+	if len(project.partials) > 0 {
+		_, err := tmpl.ParseFiles(project.partials...)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Parse the template:
 	log.Debug("Loading template from file '%s'", in)
@@ -82,7 +320,7 @@ func ProcessTemplate(project *Project, in string, out string) error {
 		return err
 	}
 	log.Debug("Creating template result file '%s'", out)
-	file, err := os.OpenFile(out, os.O_CREATE|os.O_WRONLY, info.Mode())
+	file, err := createFile(out, info.Mode())
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,164 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package build
+
+// This file contains the functions used to load the values that are
+// passed to templates as '.Values'.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-ini/ini"
+	"gopkg.in/yaml.v2"
+
+	"ovc/log"
+)
+
+// loadValues loads the values that will be passed to templates. The
+// values are taken first from the 'values' section of the project
+// file, then from the values files given in the options, and finally
+// from the 'NAME=VALUE' assignments given in the options. Each source
+// overrides the values of the previous ones.
+//
+func loadValues(file *ini.File, project *Project, options *ProjectOptions) error {
+	values := make(map[string]interface{})
+
+	// Load the values from the project file. Names of keys can
+	// contain dots to indicate nested values, for example
+	// 'database.password':
+	section, err := file.GetSection(valuesSection)
+	if err == nil {
+		for _, key := range section.Keys() {
+			err = setValue(values, key.Name(), key.Value())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Load the values files:
+	for _, path := range options.ValuesFiles {
+		log.Debug("Loading values from file '%s'", path)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Can't read values file '%s': %s", path, err)
+		}
+		var loaded interface{}
+		err = yaml.Unmarshal(data, &loaded)
+		if err != nil {
+			return fmt.Errorf("Can't parse values file '%s': %s", path, err)
+		}
+		if loaded == nil {
+			continue
+		}
+		tree, ok := normalizeValue(loaded).(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("The content of values file '%s' isn't a map", path)
+		}
+		mergeValues(values, tree)
+	}
+
+	// Apply the assignments:
+	for _, assignment := range options.SetValues {
+		equals := strings.Index(assignment, "=")
+		if equals == -1 {
+			return fmt.Errorf(
+				"Value assignment '%s' should have the form 'NAME=VALUE'",
+				assignment,
+			)
+		}
+		err = setValue(values, assignment[0:equals], assignment[equals+1:])
+		if err != nil {
+			return err
+		}
+	}
+
+	project.values = values
+	return nil
+}
+
+// setValue sets a value inside the given tree. The name is a sequence
+// of keys separated by dots, and the intermediate maps are created if
+// they don't exist.
+//
+func setValue(values map[string]interface{}, name string, value interface{}) error {
+	keys := strings.Split(name, ".")
+	for _, key := range keys {
+		if key == "" {
+			return fmt.Errorf("Value name '%s' contains an empty key", name)
+		}
+	}
+	last := len(keys) - 1
+	for i, key := range keys[0:last] {
+		next, ok := values[key].(map[string]interface{})
+		if !ok {
+			if values[key] != nil {
+				return fmt.Errorf(
+					"Can't set value '%s' because '%s' isn't a map",
+					name,
+					strings.Join(keys[0:i+1], "."),
+				)
+			}
+			next = make(map[string]interface{})
+			values[key] = next
+		}
+		values = next
+	}
+	values[keys[last]] = value
+	return nil
+}
+
+// mergeValues copies the values from the source tree to the target
+// tree. Maps present in both trees are merged recursively, any other
+// value of the source replaces the value of the target.
+//
+func mergeValues(target, source map[string]interface{}) {
+	for key, value := range source {
+		sourceMap, sourceOk := value.(map[string]interface{})
+		targetMap, targetOk := target[key].(map[string]interface{})
+		if sourceOk && targetOk {
+			mergeValues(targetMap, sourceMap)
+		} else {
+			target[key] = value
+		}
+	}
+}
+
+// normalizeValue converts the maps returned by the YAML parser, which
+// have keys of any type, into maps with string keys, so that they can
+// be used from templates and converted to JSON.
+//
+func normalizeValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			result[fmt.Sprint(key)] = normalizeValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(typed))
+		for i, item := range typed {
+			result[i] = normalizeValue(item)
+		}
+		return result
+	default:
+		return value
+	}
+}
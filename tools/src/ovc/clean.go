@@ -17,7 +17,8 @@ limitations under the License.
 package main
 
 // This tool untas all the images created by the project, so that the
-// next build will create them again.
+// next build will create them again. The images to remove can be given
+// in the command line, otherwise all the images are removed.
 
 import (
 	"fmt"
@@ -26,17 +27,34 @@ import (
 	"ovc/log"
 )
 
-func cleanTool(project *build.Project) error {
+// Command line options of the tool.
+//
+var cleanSelection imageSelection
+
+func init() {
+	tool := registerTool(
+		"clean",
+		"[IMAGE...]",
+		"Removes the images, or only the given images",
+		cleanTool,
+	)
+	cleanSelection.addFlags(tool.Flags)
+}
+
+func cleanTool(project *build.Project, args []string) error {
 	// The list of images is always returned in build order, with
 	// base images before the images that depend on them. In order
 	// to remove them without issues we need to reverse that order,
 	// so that base images are removed after the images that depend
 	// on them.
-	images := project.Images().List()
+	images, err := cleanSelection.images(project, args)
+	if err != nil {
+		return err
+	}
 	for i := len(images) - 1; i >= 0; i-- {
 		image := images[i]
 		log.Info("Remove image '%s'", image)
-		err := image.Remove()
+		err = image.Remove()
 		if err != nil {
 			return fmt.Errorf("Failed to remove image '%s'", image)
 		}
@@ -0,0 +1,56 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// This tool checks the configuration of the project, and prints the
+// effective configuration, after merging the defaults, the project
+// file, the profile, the environment and the command line.
+
+import (
+	"fmt"
+	"os"
+
+	"ovc/build"
+	"ovc/log"
+)
+
+func init() {
+	tool := registerTool(
+		"config",
+		"check|show",
+		"Checks the configuration, or shows the effective configuration",
+		configTool,
+	)
+	tool.Stdout = true
+}
+
+func configTool(project *build.Project, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("The config tool needs exactly one argument, 'check' or 'show'")
+	}
+	switch args[0] {
+	case "check":
+		// The configuration is checked when the project is loaded,
+		// so if we are here it is valid:
+		log.Info("The configuration is valid")
+		return nil
+	case "show":
+		return project.WriteConfig(os.Stdout)
+	default:
+		return fmt.Errorf("Unknown config action '%s', should be 'check' or 'show'", args[0])
+	}
+}
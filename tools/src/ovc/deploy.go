@@ -43,9 +43,50 @@ const (
 	privilegedUser = "privilegeduser"
 )
 
-func deployTool(project *build.Project) error {
+// Command line options of the tool.
+//
+var (
+	deployManifests string
+)
+
+func init() {
+	tool := registerTool(
+		"deploy",
+		"",
+		"Deploys the application to the OpenShift cluster",
+		deployTool,
+	)
+	tool.Flags.StringVar(
+		&deployManifests,
+		"manifests",
+		"",
+		"deploy the manifests of `directory`, for example the ones extracted from a bundle by the load tool, "+
+			"instead of the manifests of the project",
+	)
+}
+
+func deployTool(project *build.Project, args []string) error {
 	var err error
 
+	// This tool doesn't accept arguments:
+	if len(args) > 0 {
+		return fmt.Errorf("The deploy tool doesn't accept arguments")
+	}
+
+	// Use the manifests given in the command line, or the ones of
+	// the project:
+	manifests := deployManifests
+	if manifests == "" {
+		manifests = project.Manifests().WorkingDirectory()
+	}
+	info, err := os.Stat(manifests)
+	if err != nil {
+		return fmt.Errorf("Can't find manifests directory '%s': %s", manifests, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Manifests path '%s' isn't a directory", manifests)
+	}
+
 	// Check that the 'oc' tool is available and that it is the
 	// right version:
 	err = validateOc()
@@ -136,7 +177,7 @@ func deployTool(project *build.Project) error {
 	err = runOc(
 		"create",
 		"-f",
-		project.Manifests().WorkingDirectory(),
+		manifests,
 		"-R",
 	)
 	if err != nil {
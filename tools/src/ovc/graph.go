@@ -0,0 +1,298 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// This tool prints the graph of dependencies between the images, as a
+// text tree, in the Graphviz DOT language, or in JSON format.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"ovc/build"
+)
+
+// Command line options of the tool.
+//
+var (
+	graphFormat string
+	graphOutput string
+)
+
+func init() {
+	tool := registerTool(
+		"graph",
+		"",
+		"Prints the graph of dependencies between the images",
+		graphTool,
+	)
+	tool.Stdout = true
+	tool.Flags.StringVar(
+		&graphFormat,
+		"format",
+		"text",
+		"output `format`, one of 'text', 'dot' or 'json'",
+	)
+	tool.Flags.StringVar(
+		&graphOutput,
+		"output",
+		"",
+		"write the graph to `file` instead of to the standard output",
+	)
+}
+
+// graphNode contains the description of a node of the graph. Nodes can
+// be images of the project or external images.
+//
+type graphNode struct {
+	ID        string   `json:"id"`
+	Tag       string   `json:"tag"`
+	External  bool     `json:"external"`
+	Manifests bool     `json:"manifests"`
+	Children  []string `json:"-"`
+}
+
+// graphEdge contains the description of an edge of the graph, from an
+// image to an image that depends on it.
+//
+type graphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// imageGraph contains the complete graph, with the nodes sorted so that
+// external images are first, followed by the images of the project in
+// build order.
+//
+type imageGraph struct {
+	Nodes []*graphNode `json:"nodes"`
+	Edges []*graphEdge `json:"edges"`
+	index map[string]*graphNode
+}
+
+func graphTool(project *build.Project, args []string) error {
+	// This tool doesn't accept arguments:
+	if len(args) > 0 {
+		return fmt.Errorf("The graph tool doesn't accept arguments")
+	}
+
+	// Select the function that writes the graph:
+	var write func(io.Writer, *imageGraph) error
+	switch graphFormat {
+	case "text":
+		write = writeGraphText
+	case "dot":
+		write = writeGraphDot
+	case "json":
+		write = writeGraphJSON
+	default:
+		return fmt.Errorf(
+			"Unknown graph format '%s', should be 'text', 'dot' or 'json'",
+			graphFormat,
+		)
+	}
+
+	// Build the graph:
+	graph, err := newImageGraph(project)
+	if err != nil {
+		return err
+	}
+
+	// Write the graph:
+	out := io.Writer(os.Stdout)
+	if graphOutput != "" {
+		file, err := os.Create(graphOutput)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	return write(out, graph)
+}
+
+// newImageGraph creates the graph of dependencies between the images of
+// the given project.
+//
+func newImageGraph(project *build.Project) (graph *imageGraph, err error) {
+	graph = &imageGraph{
+		Nodes: []*graphNode{},
+		Edges: []*graphEdge{},
+		index: make(map[string]*graphNode),
+	}
+
+	// Find the images used by the manifests:
+	used, err := project.Manifests().UsedImages()
+	if err != nil {
+		return
+	}
+	manifests := make(map[*build.Image]bool)
+	for _, image := range used {
+		manifests[image] = true
+	}
+
+	// Add the external images, sorted by name:
+	images := project.Images().List()
+	for _, image := range images {
+		for _, external := range image.ExternalDependencies() {
+			if graph.index[external] == nil {
+				graph.add(&graphNode{
+					ID:       external,
+					Tag:      external,
+					External: true,
+				})
+			}
+		}
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		return graph.Nodes[i].ID < graph.Nodes[j].ID
+	})
+
+	// Add the images of the project, in build order:
+	for _, image := range images {
+		graph.add(&graphNode{
+			ID:        image.Name(),
+			Tag:       image.Tag(),
+			Manifests: manifests[image],
+		})
+	}
+
+	// Add the edges:
+	for _, image := range images {
+		for _, external := range image.ExternalDependencies() {
+			graph.connect(external, image.Name())
+		}
+		for _, dependency := range image.Dependencies() {
+			graph.connect(dependency.Name(), image.Name())
+		}
+	}
+
+	return
+}
+
+// add adds a node to the graph.
+//
+func (g *imageGraph) add(node *graphNode) {
+	g.Nodes = append(g.Nodes, node)
+	g.index[node.ID] = node
+}
+
+// connect adds an edge from a node to a node that depends on it.
+//
+func (g *imageGraph) connect(from, to string) {
+	g.Edges = append(g.Edges, &graphEdge{
+		From: from,
+		To:   to,
+	})
+	node := g.index[from]
+	node.Children = append(node.Children, to)
+}
+
+// roots returns the nodes that don't depend on any other node.
+//
+func (g *imageGraph) roots() []*graphNode {
+	targets := make(map[string]bool)
+	for _, edge := range g.Edges {
+		targets[edge.To] = true
+	}
+	roots := []*graphNode{}
+	for _, node := range g.Nodes {
+		if !targets[node.ID] {
+			roots = append(roots, node)
+		}
+	}
+	return roots
+}
+
+// label returns the text used to describe a node in the text format.
+//
+func (n *graphNode) label() string {
+	switch {
+	case n.External:
+		return fmt.Sprintf("%s (external)", n.ID)
+	case n.Manifests:
+		return fmt.Sprintf("%s [%s] (manifests)", n.ID, n.Tag)
+	default:
+		return fmt.Sprintf("%s [%s]", n.ID, n.Tag)
+	}
+}
+
+// writeGraphText writes the graph as a text tree. Images that depend on
+// multiple images appear under each of them.
+//
+func writeGraphText(out io.Writer, graph *imageGraph) error {
+	var walk func(node *graphNode, indent string, last bool)
+	walk = func(node *graphNode, indent string, last bool) {
+		branch := "|-- "
+		next := indent + "|   "
+		if last {
+			branch = "`-- "
+			next = indent + "    "
+		}
+		fmt.Fprintf(out, "%s%s%s\n", indent, branch, node.label())
+		for i, child := range node.Children {
+			walk(graph.index[child], next, i == len(node.Children)-1)
+		}
+	}
+	for _, root := range graph.roots() {
+		fmt.Fprintf(out, "%s\n", root.label())
+		for i, child := range root.Children {
+			walk(graph.index[child], "", i == len(root.Children)-1)
+		}
+	}
+	return nil
+}
+
+// writeGraphDot writes the graph in the Graphviz DOT language. External
+// images are drawn with dashed boxes, and images used by the manifests
+// are filled.
+//
+func writeGraphDot(out io.Writer, graph *imageGraph) error {
+	fmt.Fprintf(out, "digraph images {\n")
+	fmt.Fprintf(out, "  rankdir=LR;\n")
+	fmt.Fprintf(out, "  node [shape=box];\n")
+	for _, node := range graph.Nodes {
+		switch {
+		case node.External:
+			fmt.Fprintf(out, "  %q [style=dashed];\n", node.ID)
+		case node.Manifests:
+			fmt.Fprintf(out, "  %q [label=%q, style=filled, fillcolor=lightblue];\n", node.ID, node.Tag)
+		default:
+			fmt.Fprintf(out, "  %q [label=%q];\n", node.ID, node.Tag)
+		}
+	}
+	for _, edge := range graph.Edges {
+		fmt.Fprintf(out, "  %q -> %q;\n", edge.From, edge.To)
+	}
+	fmt.Fprintf(out, "}\n")
+	return nil
+}
+
+// writeGraphJSON writes the graph in JSON format, as a list of nodes and
+// a list of edges.
+//
+func writeGraphJSON(out io.Writer, graph *imageGraph) error {
+	data, err := json.MarshalIndent(graph, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}
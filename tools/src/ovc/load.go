@@ -0,0 +1,193 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// This tool loads the images contained in a bundle, created with the
+// '--bundle' option of the save tool, into the local image storage, and
+// extracts the rendered manifests and the configuration, so that they
+// can be deployed with the '--manifests' option of the deploy tool.
+// Optionally it also tags the images for a different registry, changing
+// the manifests accordingly, and pushes them, so that the application
+// can be deployed without access to the original registry. If the bundle
+// is listed in the checksums file generated by the save tool it is
+// checked, together with its metadata file, before loading it. The tool
+// doesn't need the project, so it can be used in machines that only have
+// the bundle.
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"ovc/build"
+	"ovc/log"
+)
+
+// Command line options of the tool.
+//
+var (
+	loadEngine    string
+	loadRegistry  string
+	loadPush      bool
+	loadOutputDir string
+	loadNoVerify  bool
+)
+
+func init() {
+	tool := registerTool(
+		"load",
+		"FILE",
+		"Loads the images of a bundle into the local image storage and extracts its manifests",
+		loadTool,
+	)
+	tool.NoProject = true
+	tool.Flags.StringVar(
+		&loadEngine,
+		"engine",
+		"auto",
+		"container `engine` where the images are loaded, one of 'docker', 'podman', 'buildah' or 'auto'",
+	)
+	tool.Flags.StringVar(
+		&loadRegistry,
+		"registry",
+		"",
+		"also tag the images for the given `registry`, replacing the original one, also in the manifests",
+	)
+	tool.Flags.BoolVar(
+		&loadPush,
+		"push",
+		false,
+		"push the images to the registry after loading them",
+	)
+	tool.Flags.StringVar(
+		&loadOutputDir,
+		"output-dir",
+		"",
+		"`directory` where the manifests and the configuration are extracted, "+
+			"the default is the name of the bundle without the extensions",
+	)
+	tool.Flags.BoolVar(
+		&loadNoVerify,
+		"no-verify",
+		false,
+		"don't check the bundle against the checksums and metadata files written by the save tool",
+	)
+}
+
+func loadTool(project *build.Project, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("The load tool needs exactly one argument, the bundle file")
+	}
+	bundle := args[0]
+
+	// If the bundle is listed in the checksums file created by the
+	// save tool, check it, and its metadata file, before loading it:
+	if !loadNoVerify {
+		err := verifyBundle(bundle)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Create the container engine:
+	engine, err := build.NewContainerEngine(loadEngine)
+	if err != nil {
+		return err
+	}
+
+	// Load the bundle:
+	output := loadOutputDir
+	if output == "" {
+		output = bundleDirectory(bundle)
+	}
+	index, err := build.LoadBundle(
+		bundle,
+		&build.LoadOptions{
+			Engine:    engine,
+			Registry:  loadRegistry,
+			Push:      loadPush,
+			Directory: output,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	log.Info("Loaded %d images from bundle '%s'", len(index.Images), bundle)
+	log.Info(
+		"Extracted manifests to '%s', use 'deploy --manifests %s' to deploy them",
+		output,
+		filepath.Join(output, filepath.FromSlash(index.Manifests)),
+	)
+	return nil
+}
+
+// verifyBundle checks the given bundle against the checksums file of its
+// directory, if it is listed there, and against its metadata file, if it
+// is also listed.
+//
+func verifyBundle(bundle string) error {
+	dir := filepath.Dir(bundle)
+	name := filepath.Base(bundle)
+	listed, err := build.HasChecksum(dir, name)
+	if err != nil {
+		return err
+	}
+	if !listed {
+		log.Warning(
+			"Bundle '%s' isn't listed in '%s', it won't be checked",
+			bundle,
+			filepath.Join(dir, build.ChecksumsFile),
+		)
+		return nil
+	}
+	names := []string{name}
+	metadata := filepath.Base(build.MetadataPath(bundle))
+	listed, err = build.HasChecksum(dir, metadata)
+	if err != nil {
+		return err
+	}
+	if listed {
+		names = append(names, metadata)
+	}
+	log.Info("Checking bundle '%s'", bundle)
+	problems, err := build.VerifyArtifacts(dir, names...)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Error("%s", problem)
+		}
+		return fmt.Errorf("Bundle '%s' isn't valid", bundle)
+	}
+	return nil
+}
+
+// bundleDirectory returns the default directory where the manifests and
+// the configuration of the given bundle are extracted, the path of the
+// bundle without the extensions added by the save tool.
+//
+func bundleDirectory(bundle string) string {
+	dir := bundle
+	for _, extension := range []string{".gz", ".zst", ".tar"} {
+		dir = strings.TrimSuffix(dir, extension)
+	}
+	if dir == bundle {
+		dir += ".d"
+	}
+	return dir
+}
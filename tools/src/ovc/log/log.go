@@ -24,6 +24,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 // The log file.
@@ -34,9 +35,28 @@ var file *os.File
 // The writers for the different levels.
 //
 var errorWriter io.Writer
+var warningWriter io.Writer
 var infoWriter io.Writer
 var debugWriter io.Writer
 
+// This mutex is shared by all the log writers, so that messages written
+// concurrently from different goroutines aren't mixed.
+//
+var mutex sync.Mutex
+
+// lockedWriter implements a writer that holds the log mutex while
+// writing to the underlying stream.
+//
+type lockedWriter struct {
+	stream io.Writer
+}
+
+func (l *lockedWriter) Write(data []byte) (count int, err error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return l.stream.Write(data)
+}
+
 // prefixWriter implements a writer that adds a prefix to each line.
 //
 type prefixWriter struct {
@@ -90,16 +110,72 @@ func newLogWriter(file, console io.Writer, prefix, color string) io.Writer {
 		console = newPrefixWriter(console, colored)
 		writers = append(writers, console)
 	}
-	return io.MultiWriter(writers...)
+	return &lockedWriter{
+		stream: io.MultiWriter(writers...),
+	}
 }
 
-// Open creates a log file with the given name and the .log extension,
-// and configures the log to write to it.
+// lineWriter implements a writer that adds a prefix to each line, and
+// that only writes complete lines to the underlying stream.
 //
-func Open(name string) error {
+type lineWriter struct {
+	prefix string
+	stream io.Writer
+	buffer bytes.Buffer
+}
+
+// NewLineWriter creates a writer that adds the given prefix to each
+// line and writes the modified lines to the given stream. Incomplete
+// lines are kept in memory till they are completed or till the writer
+// is closed. This is intended for the output of commands that run
+// concurrently, so that their lines don't get mixed.
+//
+func NewLineWriter(stream io.Writer, prefix string) io.WriteCloser {
+	l := new(lineWriter)
+	l.prefix = prefix
+	l.stream = stream
+	return l
+}
+
+func (l *lineWriter) Write(data []byte) (count int, err error) {
+	l.buffer.Write(data)
+	count = len(data)
+	lines := new(bytes.Buffer)
+	for {
+		end := bytes.IndexByte(l.buffer.Bytes(), '\n')
+		if end < 0 {
+			break
+		}
+		lines.WriteString(l.prefix)
+		lines.Write(l.buffer.Next(end + 1))
+	}
+	if lines.Len() > 0 {
+		_, err = l.stream.Write(lines.Bytes())
+	}
+	return
+}
+
+// Close writes the remaining incomplete line, if any, to the underlying
+// stream.
+//
+func (l *lineWriter) Close() error {
+	if l.buffer.Len() == 0 {
+		return nil
+	}
+	_, err := l.Write([]byte("\n"))
+	return err
+}
+
+// Open creates the log file with the given path, and configures the
+// log to write to it. Informative messages are also written to the
+// given console stream, usually the standard output of the process. If
+// the verbose parameter is true debug messages are also written to the
+// console stream.
+//
+func Open(name string, verbose bool, console io.Writer) error {
 	var err error
 
-	path, err = filepath.Abs(name + ".log")
+	path, err = filepath.Abs(name)
 	if err != nil {
 		return err
 	}
@@ -107,9 +183,14 @@ func Open(name string) error {
 	if err != nil {
 		return err
 	}
+	var debugConsole io.Writer
+	if verbose {
+		debugConsole = console
+	}
 	errorWriter = newLogWriter(file, os.Stderr, "ERROR", "0;31")
-	infoWriter = newLogWriter(file, os.Stdout, "INFO", "0;32")
-	debugWriter = newLogWriter(file, nil, "DEBUG", "0;34")
+	warningWriter = newLogWriter(file, os.Stderr, "WARNING", "0;33")
+	infoWriter = newLogWriter(file, console, "INFO", "0;32")
+	debugWriter = newLogWriter(file, debugConsole, "DEBUG", "0;34")
 	return nil
 }
 
@@ -132,6 +213,13 @@ func Info(format string, args ...interface{}) {
 	write(infoWriter, format, args...)
 }
 
+// Warning sends a warning message to the log file and to the standard
+// error stream of the process.
+//
+func Warning(format string, args ...interface{}) {
+	write(warningWriter, format, args...)
+}
+
 // Debug sends a debug message to the log file.
 //
 func Debug(format string, args ...interface{}) {
@@ -147,8 +235,7 @@ func Error(format string, args ...interface{}) {
 
 func write(writer io.Writer, format string, args ...interface{}) {
 	message := fmt.Sprintf(format, args...)
-	writer.Write([]byte(message))
-	writer.Write([]byte("\n"))
+	writer.Write([]byte(message + "\n"))
 }
 
 // InfoWriter returns the writer that writes informative messages to the
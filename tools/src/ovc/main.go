@@ -18,7 +18,7 @@ limitations under the License.
 // so that during run-time there is no need to have both the binary and the
 // configuration files.
 //
-//go:generate go run scripts/embed.go -directory ../../.. -output tools/src/ovc/embedded.go project.conf image-specifications os-manifests
+//go:generate go run scripts/embed.go -directory ../../.. -output tools/src/ovc/embedded.go project.conf image-specifications os-manifests templates
 
 package main
 
@@ -28,99 +28,334 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"ovc/build"
 	"ovc/log"
 )
 
-// ToolFunc is the type of functions that implement tools.
+// The name of the project file.
 //
-type ToolFunc func(project *build.Project) error
+const conf = "project.conf"
+
+// Global command line options, that apply to all the tools.
+//
+var (
+	projectFlag string
+	logFileFlag string
+	verboseFlag bool
+	workDirFlag string
+	valuesFlag  stringList
+	setFlag     stringList
+	profileFlag string
+	optionFlag  stringList
+)
 
-// This index contains the mapping from names to tool functions.
+// stringList is a flag value that collects the values of an option that
+// can be used multiple times.
 //
-var tools = map[string]ToolFunc{
-	"build":  buildTool,
-	"clean":  cleanTool,
-	"deploy": deployTool,
-	"push":   pushTool,
-	"save":   saveTool,
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-// The name of the project file.
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// The version of the project that the binary was built from. It is set
+// at build time with '-ldflags "-X main.buildVersion=..."', and it is
+// used when the project is extracted from the embedded data and its
+// version is 'auto', as the extracted files aren't inside a git
+// repository. If it isn't set the version 'dev' is used instead.
 //
-const conf = "project.conf"
+var buildVersion string
+
+// The abbreviated identifier of the git commit that the binary was built
+// from. It is set at build time with '-ldflags "-X main.buildCommit=..."',
+// and it is used by the 'GitSHA' tag format when the project is extracted
+// from the embedded data.
+//
+var buildCommit string
+
+// The flag set that contains the global command line options.
+//
+var globalFlags = flag.NewFlagSet("ovc", flag.ContinueOnError)
+
+func init() {
+	globalFlags.StringVar(
+		&projectFlag,
+		"project",
+		"",
+		"load the project from `file`, instead of from the '"+conf+"' file of the current directory",
+	)
+	globalFlags.StringVar(
+		&logFileFlag,
+		"log-file",
+		"",
+		"write the log to `file`, instead of to a file named after the tool",
+	)
+	globalFlags.BoolVar(
+		&verboseFlag,
+		"verbose",
+		false,
+		"also write debug messages to the console",
+	)
+	globalFlags.StringVar(
+		&workDirFlag,
+		"work-dir",
+		"",
+		"store the results of processing templates in `directory`, and keep it when finished",
+	)
+	globalFlags.StringVar(
+		&profileFlag,
+		"profile",
+		"",
+		"apply the configuration `profile`, the default is the value of the 'OVC_PROFILE' environment variable",
+	)
+	globalFlags.Var(
+		&optionFlag,
+		"option",
+		"set the configuration value `section.key=value`, can be used multiple times",
+	)
+	globalFlags.Var(
+		&valuesFlag,
+		"values",
+		"load template values from the YAML `file`, can be used multiple times",
+	)
+	globalFlags.Var(
+		&setFlag,
+		"set",
+		"set the template value `name=value`, can be used multiple times",
+	)
+	globalFlags.Usage = func() {
+		printUsage(os.Stderr)
+	}
+}
+
+// Exit codes of the program.
+//
+const (
+	exitOk    = 0
+	exitError = 1
+	exitUsage = 2
+)
 
 func main() {
+	// Parse the global options:
+	err := globalFlags.Parse(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(exitOk)
+	}
+	if err != nil {
+		os.Exit(exitUsage)
+	}
+
 	// Get the name of the tool:
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s TOOL [ARGS...]\n", filepath.Base(os.Args[0]))
-		os.Exit(1)
+	if globalFlags.NArg() < 1 {
+		printUsage(os.Stderr)
+		os.Exit(exitUsage)
 	}
-	name := os.Args[1]
+	name := globalFlags.Arg(0)
 
-	// Find the function that corresponds to the tool name:
+	// Find the tool that corresponds to the name:
 	tool := tools[name]
 	if tool == nil {
 		fmt.Fprintf(os.Stderr, "Can't find tool named '%s'.\n", name)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Use '%s help' to get the list of tools.\n", program())
+		os.Exit(exitUsage)
+	}
+
+	// Parse the options of the tool:
+	args, err := parseToolFlags(tool.Flags, globalFlags.Args()[1:])
+	if err == flag.ErrHelp {
+		os.Exit(exitOk)
+	}
+	if err != nil {
+		os.Exit(exitUsage)
+	}
+
+	// Standalone tools don't need the project or the log, so they
+	// are called directly:
+	if tool.Standalone {
+		err = tool.Run(nil, args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(exitError)
+		}
+		os.Exit(exitOk)
 	}
 
 	// Run the tool inside a different function, so that we can take
 	// advantage of the 'defer' mechanism:
-	os.Exit(run(name, tool))
+	os.Exit(run(tool, args))
 }
 
-func run(name string, tool ToolFunc) int {
+// parseToolFlags parses the options of a tool, which can appear before,
+// after or between the arguments, so that for example 'build engine
+// --force' is equivalent to 'build --force engine'. As usual, all the
+// arguments after '--' are treated as arguments, even if they start
+// with a dash, unless that '--' is the value of an option, like in
+// '--output-dir --'. Returns the arguments that aren't options.
+//
+func parseToolFlags(flags *flag.FlagSet, args []string) (positional []string, err error) {
+	positional = []string{}
+
+	// Separate the arguments that follow the terminator, as the flag
+	// package can't tell us if it stopped because of it:
+	var trailing []string
+	terminator := findTerminator(flags, args)
+	if terminator >= 0 {
+		trailing = args[terminator+1:]
+		args = args[0:terminator]
+	}
+
+	// Parse the options, which stops at the first argument, and
+	// continue after it:
+	for {
+		err = flags.Parse(args)
+		if err != nil {
+			return
+		}
+		rest := flags.Args()
+		if len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+	positional = append(positional, trailing...)
+	return
+}
+
+// findTerminator returns the index of the '--' argument that marks the
+// end of the options, or -1 if there is no such argument. An argument
+// '--' that is the value of an option, like in '--output-dir --', isn't
+// a terminator.
+//
+func findTerminator(flags *flag.FlagSet, args []string) int {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return i
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		option := flags.Lookup(name)
+		if option == nil {
+			continue
+		}
+		if value, ok := option.Value.(interface{ IsBoolFlag() bool }); ok && value.IsBoolFlag() {
+			continue
+		}
+
+		// The next argument is the value of the option:
+		i++
+	}
+	return -1
+}
+
+func run(tool *Tool, args []string) int {
 	// Open the log:
-	log.Open(name)
+	path := logFileFlag
+	if path == "" {
+		path = tool.Name + ".log"
+	}
+	console := os.Stdout
+	if tool.Stdout {
+		console = os.Stderr
+	}
+	err := log.Open(path, verboseFlag, console)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't open log file '%s': %s\n", path, err)
+		return exitError
+	}
 	log.Info("Log file is '%s'", log.Path())
 	defer log.Close()
 
-	// Check if the project file exists. If doesn't exist then we
-	// need extract it, together with the rest of the source files
-	// of the project, from the embedded data.
-	file, _ := filepath.Abs(conf)
-	if _, err := os.Stat(file); os.IsNotExist(err) {
-		log.Info("Extracting project")
-		tmp, err := ioutil.TempDir("", "project")
-		if err != nil {
-			log.Error("Can't create temporary directory for project: %s", err)
-			os.Exit(1)
-		}
-		defer os.RemoveAll(tmp)
-		err = extractData(embedded, tmp)
-		if err != nil {
-			log.Error("Can't extract project: %s", err)
-			os.Exit(1)
+	// Tools that don't need the project are called without loading
+	// it:
+	if tool.NoProject {
+		return runTool(tool, nil, args)
+	}
+
+	// If the project file has been given explicitly then use it,
+	// otherwise check if it exists in the current directory. If it
+	// doesn't exist then we need extract it, together with the rest
+	// of the source files of the project, from the embedded data.
+	file := projectFlag
+	version := ""
+	commit := ""
+	extracted := false
+	if file == "" {
+		file, _ = filepath.Abs(conf)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			log.Info("Extracting project")
+			tmp, err := ioutil.TempDir("", "project")
+			if err != nil {
+				log.Error("Can't create temporary directory for project: %s", err)
+				return exitError
+			}
+			defer os.RemoveAll(tmp)
+			err = extractData(embedded, tmp)
+			if err != nil {
+				log.Error("Can't extract project: %s", err)
+				return exitError
+			}
+			file = filepath.Join(tmp, conf)
+			version = buildVersion
+			commit = buildCommit
+			extracted = true
 		}
-		file = filepath.Join(tmp, conf)
 	}
 
 	// Load the project:
 	log.Info("Loading project file '%s'", file)
-	project, err := build.LoadProject(file)
+	project, err := build.LoadProject(file, &build.ProjectOptions{
+		WorkDir:     workDirFlag,
+		ValuesFiles: valuesFlag,
+		SetValues:   setFlag,
+		Profile:     profileFlag,
+		Options:     optionFlag,
+		Version:     version,
+		Commit:      commit,
+		Extracted:   extracted,
+	})
 	if err != nil {
 		log.Error("%s", err)
-		return 1
+		return exitError
 	}
 	defer project.Close()
 
-	// Call the tool function:
-	log.Debug("Running tool '%s'", name)
-	err = tool(project)
+	return runTool(tool, project, args)
+}
+
+// runTool calls the function of the given tool and writes the result to
+// the log. Returns the exit code of the program.
+//
+func runTool(tool *Tool, project *build.Project, args []string) int {
+	log.Debug("Running tool '%s'", tool.Name)
+	err := tool.Run(project, args)
 	if err != nil {
 		log.Error("%s", err)
 		log.Error("Tool failed, check log file '%s' for details", log.Path())
-		return 1
+		return exitError
 	} else {
 		log.Info("Tool finished successfully")
-		return 0
+		return exitOk
 	}
 }
 
@@ -0,0 +1,114 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseToolFlags(t *testing.T) {
+	tests := []struct {
+		args       string
+		positional []string
+		outputDir  string
+		jobs       int
+		force      bool
+	}{
+		{
+			args:       "engine --jobs 2",
+			positional: []string{"engine"},
+			jobs:       2,
+		},
+		{
+			args:       "--force engine vdsc --output-dir out",
+			positional: []string{"engine", "vdsc"},
+			outputDir:  "out",
+			force:      true,
+		},
+		{
+			args:       "engine -- --jobs 2",
+			positional: []string{"engine", "--jobs", "2"},
+		},
+		{
+			args:       "--output-dir -- engine --jobs 2",
+			positional: []string{"engine"},
+			outputDir:  "--",
+			jobs:       2,
+		},
+		{
+			args:       "--output-dir=x -- --force",
+			positional: []string{"--force"},
+			outputDir:  "x",
+		},
+		{
+			args:       "--force -- engine",
+			positional: []string{"engine"},
+			force:      true,
+		},
+	}
+	for _, test := range tests {
+		var (
+			outputDir string
+			jobs      int
+			force     bool
+		)
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		flags.StringVar(&outputDir, "output-dir", "", "")
+		flags.IntVar(&jobs, "jobs", 0, "")
+		flags.BoolVar(&force, "force", false, "")
+		positional, err := parseToolFlags(flags, strings.Fields(test.args))
+		if err != nil {
+			t.Errorf("Unexpected error for '%s': %s", test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(positional, test.positional) {
+			t.Errorf("Expected arguments %q for '%s', got %q", test.positional, test.args, positional)
+		}
+		if outputDir != test.outputDir || jobs != test.jobs || force != test.force {
+			t.Errorf(
+				"Expected options '%s', %d and %t for '%s', got '%s', %d and %t",
+				test.outputDir, test.jobs, test.force, test.args, outputDir, jobs, force,
+			)
+		}
+	}
+}
+
+func TestPathWithin(t *testing.T) {
+	tests := []struct {
+		path     string
+		dir      string
+		expected bool
+	}{
+		{"/project", "/project", true},
+		{"/project/rendered", "/project", true},
+		{"/project", "/project/rendered", false},
+		{"/project-rendered", "/project", false},
+		{"/project/..rendered", "/project", true},
+		{"/other", "/project", false},
+	}
+	for _, test := range tests {
+		actual := pathWithin(test.path, test.dir)
+		if actual != test.expected {
+			t.Errorf("Expected %t for '%s' within '%s', got %t", test.expected, test.path, test.dir, actual)
+		}
+	}
+}
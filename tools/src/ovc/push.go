@@ -16,7 +16,9 @@ limitations under the License.
 
 package main
 
-// This tool pushes the image to the docker registry.
+// This tool pushes the images to the docker registry. The images to
+// push can be given in the command line, otherwise all the images are
+// pushed.
 
 import (
 	"fmt"
@@ -25,10 +27,31 @@ import (
 	"ovc/log"
 )
 
-func pushTool(project *build.Project) error {
-	for _, image := range project.Images().List() {
+// Command line options of the tool.
+//
+var pushSelection imageSelection
+
+func init() {
+	tool := registerTool(
+		"push",
+		"[IMAGE...]",
+		"Pushes the images, or only the given images, to the registry",
+		pushTool,
+	)
+	pushSelection.addFlags(tool.Flags)
+}
+
+func pushTool(project *build.Project, args []string) error {
+	// Select the images given in the command line, or all the
+	// images if none is given:
+	images, err := pushSelection.images(project, args)
+	if err != nil {
+		return err
+	}
+
+	for _, image := range images {
 		log.Info("Pushing image '%s'", image)
-		err := image.Push()
+		err = image.Push()
 		if err != nil {
 			return fmt.Errorf("Failed to push image '%s': %s", image, err)
 		}
@@ -0,0 +1,242 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// This tool writes the results of processing the templates of the image
+// specifications and of the manifests to a directory, so that they can
+// be inspected, reviewed or used by other tools.
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"ovc/build"
+	"ovc/log"
+)
+
+// renderMarker is the name of the file that the tool writes to the
+// output directory to remember the directories that it created, so that
+// it never removes directories that it didn't create.
+//
+const renderMarker = ".ovc-render"
+
+// Command line options of the tool.
+//
+var (
+	renderOutput string
+	renderOnly   string
+	renderDiff   bool
+)
+
+func init() {
+	tool := registerTool(
+		"render",
+		"",
+		"Writes the processed image specifications and manifests to a directory",
+		renderTool,
+	)
+	tool.Stdout = true
+	tool.Flags.StringVar(
+		&renderOutput,
+		"output",
+		"",
+		"write the results to `directory`, replacing the results of previous renders",
+	)
+	tool.Flags.StringVar(
+		&renderOnly,
+		"only",
+		"",
+		"write only the `part` of the project, either 'manifests' or 'images'",
+	)
+	tool.Flags.BoolVar(
+		&renderDiff,
+		"diff",
+		false,
+		"print the differences with the results of the previous render",
+	)
+}
+
+func renderTool(project *build.Project, args []string) error {
+	// Check the options and arguments:
+	if len(args) > 0 {
+		return fmt.Errorf("The render tool doesn't accept arguments")
+	}
+	if renderOutput == "" {
+		return fmt.Errorf("The output directory is mandatory")
+	}
+	output, err := resolvePath(renderOutput)
+	if err != nil {
+		return err
+	}
+
+	// Refuse to write to the source directories of the project, as the
+	// results of previous renders are removed:
+	sources := []string{
+		project.Directory(),
+		project.Images().Directory(),
+		project.Manifests().Directory(),
+	}
+	for _, source := range sources {
+		source, err = resolvePath(source)
+		if err != nil {
+			return err
+		}
+		if pathWithin(output, source) || pathWithin(source, output) {
+			return fmt.Errorf(
+				"The output directory '%s' overlaps the project directory '%s'",
+				output, source,
+			)
+		}
+	}
+
+	// Load the list of directories created by previous renders:
+	rendered, err := readRenderMarker(output)
+	if err != nil {
+		return err
+	}
+
+	// Select the working directories to render:
+	dirs := []string{}
+	switch renderOnly {
+	case "":
+		dirs = append(dirs, project.Images().WorkingDirectory())
+		dirs = append(dirs, project.Manifests().WorkingDirectory())
+	case "images":
+		dirs = append(dirs, project.Images().WorkingDirectory())
+	case "manifests":
+		dirs = append(dirs, project.Manifests().WorkingDirectory())
+	default:
+		return fmt.Errorf(
+			"Unknown part '%s', should be 'manifests' or 'images'",
+			renderOnly,
+		)
+	}
+
+	// Copy the working directories to the output directory, with
+	// the same layout that they have in the project:
+	for _, dir := range dirs {
+		path, err := filepath.Rel(project.WorkingDirectory(), dir)
+		if err != nil {
+			return err
+		}
+		out := filepath.Join(output, path)
+		if renderDiff {
+			_, err = build.DiffDirectories(os.Stdout, out, dir)
+			if err != nil {
+				return fmt.Errorf("Can't compare '%s' to '%s': %s", out, dir, err)
+			}
+		}
+		log.Info("Writing '%s' to '%s'", path, out)
+		_, err = os.Stat(out)
+		if err == nil && !rendered[path] {
+			return fmt.Errorf(
+				"Directory '%s' already exists and wasn't created by the render tool",
+				out,
+			)
+		}
+		err = os.RemoveAll(out)
+		if err != nil {
+			return err
+		}
+		err = build.CopyDirectory(dir, out)
+		if err != nil {
+			return err
+		}
+		rendered[path] = true
+		err = writeRenderMarker(output, rendered)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolvePath returns the absolute path of the given file, with the
+// symbolic links resolved when the file exists.
+//
+func resolvePath(path string) (result string, err error) {
+	result, err = filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	resolved, err := filepath.EvalSymlinks(result)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	result = resolved
+	return
+}
+
+// pathWithin checks if the given path is the given directory or is
+// inside it. Both should be absolute and clean.
+//
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// readRenderMarker reads the marker file of the given output directory,
+// and returns the set of directories that were created by previous
+// renders. If there is no marker file the set is empty.
+//
+func readRenderMarker(output string) (rendered map[string]bool, err error) {
+	rendered = make(map[string]bool)
+	file, err := os.Open(filepath.Join(output, renderMarker))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			rendered[line] = true
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// writeRenderMarker writes the marker file of the given output
+// directory, containing the directories created by the renders.
+//
+func writeRenderMarker(output string, rendered map[string]bool) error {
+	paths := make([]string, 0, len(rendered))
+	for path := range rendered {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	data := strings.Join(paths, "\n") + "\n"
+	return ioutil.WriteFile(filepath.Join(output, renderMarker), []byte(data), 0644)
+}
@@ -16,23 +16,198 @@ limitations under the License.
 
 package main
 
-// This tool saves the images to tar files.
+// This tool saves the images to compressed tar files, in docker-archive
+// or OCI format. The images to save can be given in the command line,
+// otherwise all the images are saved. Images are saved concurrently,
+// and in docker-archive format the output of the container engine is
+// compressed while it is written, so the uncompressed tar files are
+// never written to disk. Alternatively, all the images, the rendered
+// manifests and the effective configuration can be written to a single
+// bundle file, that can then be loaded with the load tool. The checksums
+// of the written files are added to the 'SHA256SUMS' file of the output
+// directory, and each saved image is described by a metadata file, so
+// that they can be checked with the verify-artifacts tool.
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
 
 	"ovc/build"
 	"ovc/log"
 )
 
-func saveTool(project *build.Project) error {
-	for _, image := range project.Images().List() {
-		log.Info("Saving image '%s'", image)
-		err := image.Save()
+// Command line options of the tool.
+//
+var (
+	saveSelection   imageSelection
+	saveJobs        int
+	saveOutputDir   string
+	saveFileName    string
+	saveCompression string
+	saveFormat      string
+	saveBundle      string
+)
+
+func init() {
+	tool := registerTool(
+		"save",
+		"[IMAGE...]",
+		"Saves the images, or only the given images, to tar files",
+		saveTool,
+	)
+	saveSelection.addFlags(tool.Flags)
+	tool.Flags.IntVar(
+		&saveJobs,
+		"jobs",
+		runtime.NumCPU(),
+		"maximum `number` of images to save concurrently",
+	)
+	tool.Flags.StringVar(
+		&saveOutputDir,
+		"output-dir",
+		".",
+		"`directory` where the files will be written",
+	)
+	tool.Flags.StringVar(
+		&saveFileName,
+		"file-name",
+		build.DefaultSavePattern,
+		"`pattern` used to calculate the names of the files, can use "+
+			"'{{.Name}}', '{{.Tag}}', '{{.Version}}' and '{{.Ext}}', and "+
+			"directories inside the output directory",
+	)
+	tool.Flags.StringVar(
+		&saveCompression,
+		"compression",
+		build.CompressionGzip,
+		"compression `algorithm`, one of 'gzip', 'pgzip', 'zstd' or 'none'",
+	)
+	tool.Flags.StringVar(
+		&saveFormat,
+		"format",
+		build.FormatDockerArchive,
+		"`format` of the images, one of 'docker-archive', 'oci' or 'oci-dir'",
+	)
+	tool.Flags.StringVar(
+		&saveBundle,
+		"bundle",
+		"",
+		"write the images, the rendered manifests and the configuration to a single bundle `file`",
+	)
+}
+
+func saveTool(project *build.Project, args []string) error {
+	// Select the images given in the command line, or all the
+	// images if none is given:
+	images, err := saveSelection.images(project, args)
+	if err != nil {
+		return err
+	}
+
+	// Check the options before starting to save anything:
+	err = build.CheckCompression(saveCompression)
+	if err != nil {
+		return err
+	}
+	err = build.CheckFormat(saveFormat)
+	if err != nil {
+		return err
+	}
+
+	// Write the bundle, if requested:
+	if saveBundle != "" {
+		dir := filepath.Dir(saveBundle)
+		err = os.MkdirAll(dir, 0755)
 		if err != nil {
-			return fmt.Errorf("Failed to save image '%s': %s", image, err)
+			return fmt.Errorf("Can't create directory '%s' for bundle '%s': %s", dir, saveBundle, err)
 		}
+		log.Info("Saving bundle '%s' with up to %d concurrent jobs", saveBundle, saveJobs)
+		err = project.SaveBundle(
+			saveBundle,
+			images,
+			&build.BundleOptions{
+				Compression: saveCompression,
+				Format:      saveFormat,
+				Jobs:        saveJobs,
+			},
+		)
+		if err != nil {
+			return err
+		}
+		return writeChecksums(dir, []string{saveBundle, build.MetadataPath(saveBundle)})
 	}
 
-	return nil
+	// Otherwise write each image to a separate file:
+	options := &build.SaveOptions{
+		Directory:   saveOutputDir,
+		Pattern:     saveFileName,
+		Compression: saveCompression,
+		Format:      saveFormat,
+	}
+
+	// Check that the file name pattern gives a different file to each
+	// image, otherwise they would overwrite each other:
+	owners := make(map[string]*build.Image)
+	for _, image := range images {
+		path, err := image.SavePath(options)
+		if err != nil {
+			return err
+		}
+		path = filepath.Clean(path)
+		if owner, present := owners[path]; present {
+			return fmt.Errorf(
+				"Images '%s' and '%s' would be saved to the same file '%s', "+
+					"use a file name pattern that contains '{{.Name}}' or '{{.Tag}}'",
+				owner,
+				image,
+				path,
+			)
+		}
+		owners[path] = image
+	}
+
+	// Create the output directory:
+	err = os.MkdirAll(saveOutputDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Can't create output directory '%s': %s", saveOutputDir, err)
+	}
+
+	// Save the images. The order doesn't matter, as saving an image
+	// doesn't need the files of any other image:
+	log.Info("Saving images with up to %d concurrent jobs", saveJobs)
+	var (
+		paths []string
+		mutex sync.Mutex
+	)
+	err = build.RunConcurrently(
+		images,
+		saveJobs,
+		func(image *build.Image) error {
+			log.Info("Saving image '%s'", image)
+			path, err := image.Save(options)
+			if err != nil {
+				return fmt.Errorf("Failed to save image '%s': %s", image, err)
+			}
+			log.Info("Saved image '%s' to '%s'", image, path)
+			mutex.Lock()
+			paths = append(paths, path, build.MetadataPath(path))
+			mutex.Unlock()
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return writeChecksums(saveOutputDir, paths)
+}
+
+// writeChecksums adds the checksums of the given files to the checksums
+// file of the given directory.
+//
+func writeChecksums(dir string, paths []string) error {
+	log.Info("Writing checksums to '%s'", filepath.Join(dir, build.ChecksumsFile))
+	return build.WriteChecksums(dir, paths)
 }
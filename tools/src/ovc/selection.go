@@ -0,0 +1,53 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// This file contains the functions used by the tools to select the
+// images that they act on, from the names given in the command line.
+
+import (
+	"flag"
+
+	"ovc/build"
+)
+
+// imageSelection contains the command line options that control how
+// images are selected.
+//
+type imageSelection struct {
+	descendants bool
+}
+
+// addFlags adds to the given flag set the options that control how
+// images are selected.
+//
+func (s *imageSelection) addFlags(flags *flag.FlagSet) {
+	flags.BoolVar(
+		&s.descendants,
+		"with-descendants",
+		false,
+		"also select the images that are built on top of the selected images",
+	)
+}
+
+// images returns the images of the project that have the given names,
+// sorted in build order. If no name is given then all the images of the
+// project are returned.
+//
+func (s *imageSelection) images(project *build.Project, names []string) ([]*build.Image, error) {
+	return project.Images().Select(names, s.descendants)
+}
@@ -0,0 +1,189 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// This file contains the registry of tools, and the functions used to
+// print the help of the command line.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"ovc/build"
+)
+
+// ToolFunc is the type of functions that implement tools. The args
+// parameter contains the command line arguments that follow the name
+// of the tool and its options.
+//
+type ToolFunc func(project *build.Project, args []string) error
+
+// Tool contains the description of a tool, the options that it accepts
+// and the function that implements it.
+//
+type Tool struct {
+	// The name of the tool, as used in the command line.
+	Name string
+
+	// The synopsis of the arguments of the tool, for example
+	// '[IMAGE...]'.
+	Args string
+
+	// One line description of the tool, used in the help.
+	Description string
+
+	// The flag set that contains the options of the tool.
+	Flags *flag.FlagSet
+
+	// The function that implements the tool.
+	Run ToolFunc
+
+	// Standalone tools don't need the project, the log file or the
+	// working directory, and are called with a nil project.
+	Standalone bool
+
+	// Tools that don't need the project, but that do use the log
+	// file, set this flag, so that they can be used in machines
+	// that don't have the project. They are called with a nil
+	// project.
+	NoProject bool
+
+	// Tools that write their results to the standard output set this
+	// flag, so that log messages are written to the standard error
+	// stream instead.
+	Stdout bool
+}
+
+// This index contains the mapping from names to tools. Tools are added
+// with the registerTool function, from the init function of the file
+// that implements them.
+//
+var tools = make(map[string]*Tool)
+
+// registerTool adds a tool to the index and creates its flag set, so
+// that the caller can add the options of the tool.
+//
+func registerTool(name, args, description string, run ToolFunc) *Tool {
+	tool := &Tool{
+		Name:        name,
+		Args:        args,
+		Description: description,
+		Run:         run,
+	}
+	tool.Flags = flag.NewFlagSet(name, flag.ContinueOnError)
+	tool.Flags.SetOutput(os.Stderr)
+	tool.Flags.Usage = func() {
+		printToolUsage(os.Stderr, tool)
+	}
+	tools[name] = tool
+	return tool
+}
+
+// toolNames returns the names of the registered tools, sorted
+// alphabetically.
+//
+func toolNames() []string {
+	names := make([]string, 0, len(tools))
+	for name := range tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// program returns the name of the program, as used in the usage
+// messages.
+//
+func program() string {
+	return filepath.Base(os.Args[0])
+}
+
+// printUsage writes the general usage message, including the global
+// options and the list of tools, to the given writer.
+//
+func printUsage(out io.Writer) {
+	fmt.Fprintf(out, "Usage: %s [OPTIONS] TOOL [TOOL OPTIONS] [ARGS...]\n", program())
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Options:\n")
+	globalFlags.SetOutput(out)
+	globalFlags.PrintDefaults()
+	globalFlags.SetOutput(os.Stderr)
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Tools:\n")
+	names := toolNames()
+	width := 0
+	for _, name := range names {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-*s %s\n", width, name, tools[name].Description)
+	}
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Use '%s help TOOL' for more information about a tool.\n", program())
+}
+
+// printToolUsage writes the usage message of the given tool, including
+// its options, to the given writer.
+//
+func printToolUsage(out io.Writer, tool *Tool) {
+	fmt.Fprintf(out, "Usage: %s [OPTIONS] %s [TOOL OPTIONS] %s\n", program(), tool.Name, tool.Args)
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "%s.\n", tool.Description)
+	count := 0
+	tool.Flags.VisitAll(func(*flag.Flag) {
+		count++
+	})
+	if count > 0 {
+		fmt.Fprintf(out, "\n")
+		fmt.Fprintf(out, "Tool options:\n")
+		tool.Flags.SetOutput(out)
+		tool.Flags.PrintDefaults()
+		tool.Flags.SetOutput(os.Stderr)
+	}
+}
+
+func init() {
+	tool := registerTool(
+		"help",
+		"[TOOL]",
+		"Shows the list of tools, or the details of one tool",
+		helpTool,
+	)
+	tool.Standalone = true
+}
+
+func helpTool(project *build.Project, args []string) error {
+	switch len(args) {
+	case 0:
+		printUsage(os.Stdout)
+	case 1:
+		tool, present := tools[args[0]]
+		if !present {
+			return fmt.Errorf("Can't find tool named '%s'", args[0])
+		}
+		printToolUsage(os.Stdout, tool)
+	default:
+		return fmt.Errorf("The help tool accepts at most one argument")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright (c) 2017 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// This tool checks the artifacts generated by the save tool against the
+// 'SHA256SUMS' file and the metadata files, so that corrupted copies are
+// detected before trying to load them. It doesn't need the project, so
+// it can be used in the machines where the artifacts are loaded.
+
+import (
+	"fmt"
+	"os"
+
+	"ovc/build"
+)
+
+func init() {
+	tool := registerTool(
+		"verify-artifacts",
+		"DIR",
+		"Checks the checksums and metadata of the saved artifacts of a directory",
+		verifyTool,
+	)
+	tool.Standalone = true
+}
+
+func verifyTool(project *build.Project, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("The verify-artifacts tool needs exactly one argument, the directory")
+	}
+	dir := args[0]
+	problems, err := build.VerifyArtifacts(dir)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stdout, "%s\n", problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Found %d problems in the artifacts of directory '%s'", len(problems), dir)
+	}
+	fmt.Fprintf(os.Stdout, "The artifacts of directory '%s' are correct\n", dir)
+	return nil
+}